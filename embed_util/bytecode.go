@@ -0,0 +1,141 @@
+package embed_util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// compileBytecodeScript is executed by the host interpreter. It reads the files to compile from stdin and writes the
+// compiled files into the directory given as first argument, using the default __pycache__ layout.
+const compileBytecodeScript = `
+import importlib.util, json, os, py_compile, sys
+
+out = sys.argv[1]
+result = {"cacheTag": sys.implementation.cache_tag, "compiled": [], "failed": []}
+for f in json.load(sys.stdin):
+    cfile = importlib.util.cache_from_source(os.path.join(out, f["name"]))
+    try:
+        py_compile.compile(f["src"], cfile=cfile, dfile=f["name"], doraise=True,
+                           invalidation_mode=py_compile.PycInvalidationMode.UNCHECKED_HASH)
+        result["compiled"].append({"name": f["name"], "pyc": os.path.relpath(cfile, out)})
+    except py_compile.PyCompileError as e:
+        result["failed"].append({"name": f["name"], "error": str(e)})
+json.dump(result, sys.stdout)
+`
+
+type compileBytecodeFile struct {
+	Name  string `json:"name"`
+	Src   string `json:"src,omitempty"`
+	Pyc   string `json:"pyc,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type compileBytecodeResult struct {
+	CacheTag string                `json:"cacheTag"`
+	Compiled []compileBytecodeFile `json:"compiled"`
+	Failed   []compileBytecodeFile `json:"failed"`
+}
+
+// applyCompileBytecode compiles all .py files of the file list with the given interpreter and adds the resulting
+// .pyc files to the file list. The .pyc files are written to tmpDir. Files that fail to compile (e.g. because they
+// use syntax of another Python version) are skipped with a warning.
+func applyCompileBytecode(dir string, tmpDir string, fl *fileList, pythonExe string) error {
+	var files []compileBytecodeFile
+	for _, fle := range fl.Files {
+		if fle.Mode.IsRegular() && filepath.Ext(fle.Name) == ".py" {
+			src, err := filepath.Abs(fle.sourcePath(dir))
+			if err != nil {
+				return err
+			}
+			files = append(files, compileBytecodeFile{Name: fle.Name, Src: src})
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	pycDir := filepath.Join(tmpDir, "pyc")
+	input, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+
+	// -I protects the host interpreter from the environment and -B keeps it from writing bytecode for its own imports
+	cmd := exec.Command(pythonExe, "-I", "-B", "-c", compileBytecodeScript, pycDir)
+	cmd.Stdin = bytes.NewReader(input)
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to compile bytecode with %s: %w\n%s", pythonExe, err, stderr.String())
+	}
+	var result compileBytecodeResult
+	err = json.Unmarshal(out, &result)
+	if err != nil {
+		return fmt.Errorf("failed to parse result of bytecode compilation: %w", err)
+	}
+
+	for _, f := range result.Failed {
+		log.Warningf("failed to compile %s, skipping it: %s", f.Name, strings.TrimSpace(f.Error))
+	}
+	log.Infof("compiled %d files to bytecode for %s", len(result.Compiled), result.CacheTag)
+
+	m := fl.toMap()
+	for _, f := range result.Compiled {
+		pycDirName := filepath.Dir(f.Pyc)
+		if _, ok := m[pycDirName]; !ok {
+			m[pycDirName] = fileListEntry{
+				Name:    pycDirName,
+				Mode:    os.ModeDir | 0o755,
+				srcPath: filepath.Join(pycDir, pycDirName),
+			}
+		}
+
+		srcPath := filepath.Join(pycDir, f.Pyc)
+		st, err := os.Stat(srcPath)
+		if err != nil {
+			return err
+		}
+		m[f.Pyc] = fileListEntry{
+			Name:    f.Pyc,
+			Size:    st.Size(),
+			Mode:    0o644,
+			srcPath: srcPath,
+		}
+	}
+
+	files2 := make([]fileListEntry, 0, len(m))
+	for _, fle := range m {
+		files2 = append(files2, fle)
+	}
+	sort.Slice(files2, func(i, j int) bool {
+		return files2[i].Name < files2[j].Name
+	})
+	fl.Files = files2
+	return nil
+}
+
+// isBytecodeEntry returns true for __pycache__ directories and the .pyc files inside
+func isBytecodeEntry(fle fileListEntry) bool {
+	if fle.Mode.IsDir() {
+		return filepath.Base(fle.Name) == "__pycache__"
+	}
+	return fle.Mode.IsRegular() && filepath.Ext(fle.Name) == ".pyc" && filepath.Base(filepath.Dir(fle.Name)) == "__pycache__"
+}
+
+// legacyBytecodeName maps pkg/__pycache__/mod.<cache tag>.pyc to pkg/mod.pyc, which is where zipimport looks for
+// bytecode
+func legacyBytecodeName(name string) string {
+	pkgDir := filepath.Dir(filepath.Dir(name))
+	base := filepath.Base(name)
+	mod := strings.SplitN(base, ".", 2)[0]
+	return filepath.Join(pkgDir, mod+".pyc")
+}
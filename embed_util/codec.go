@@ -0,0 +1,220 @@
+package embed_util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression codec of an embedded file, as recorded in files.json.
+type Codec string
+
+const (
+	CodecNone Codec = "none"
+	CodecGzip Codec = "gzip"
+	CodecZstd Codec = "zstd"
+)
+
+// extension returns the extension that is appended to the names of embedded files compressed with the codec
+func (c Codec) extension() (string, error) {
+	switch c {
+	case CodecNone:
+		return "", nil
+	case CodecGzip:
+		return ".gz", nil
+	case CodecZstd:
+		return ".zst", nil
+	default:
+		return "", fmt.Errorf("unsupported codec %q", string(c))
+	}
+}
+
+// CompressionPolicy decides which files are compressed while packing, see WithCompressionPolicy.
+type CompressionPolicy int
+
+const (
+	// CompressBinary only compresses files that are not detected as text. This is the default.
+	CompressBinary CompressionPolicy = iota
+	// CompressAll compresses all files, including text files such as .py sources.
+	CompressAll
+	// CompressNone does not compress any files.
+	CompressNone
+)
+
+// zstdDictName is the name of the embedded file containing the zstd dictionary, see WithZstdDictionary
+const zstdDictName = "files.zstd-dict"
+
+// fileEncoder compresses files while packing. It is safe for concurrent use.
+type fileEncoder struct {
+	codec  Codec
+	policy CompressionPolicy
+	level  int
+	zstd   *zstd.Encoder
+}
+
+func newFileEncoder(o *copyOptions) (*fileEncoder, error) {
+	e := &fileEncoder{
+		codec:  o.codec,
+		policy: o.compressionPolicy,
+		level:  o.compressionLevel,
+	}
+	if e.codec == "" {
+		e.codec = CodecGzip
+	}
+	if _, err := e.codec.extension(); err != nil {
+		return nil, err
+	}
+	if o.zstdDict != nil && e.codec != CodecZstd {
+		return nil, fmt.Errorf("a zstd dictionary can only be used with the zstd codec")
+	}
+
+	switch e.codec {
+	case CodecGzip:
+		if e.level == 0 {
+			e.level = gzip.BestCompression
+		}
+		if _, err := gzip.NewWriterLevel(io.Discard, e.level); err != nil {
+			return nil, err
+		}
+	case CodecZstd:
+		zstdLevel := zstd.SpeedBestCompression
+		if e.level != 0 {
+			zstdLevel = zstd.EncoderLevelFromZstd(e.level)
+		}
+		opts := []zstd.EOption{zstd.WithEncoderLevel(zstdLevel)}
+		if o.zstdDict != nil {
+			opts = append(opts, zstd.WithEncoderDict(o.zstdDict))
+		}
+		var err error
+		e.zstd, err = zstd.NewWriter(nil, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+	}
+	return e, nil
+}
+
+func (e *fileEncoder) close() {
+	if e.zstd != nil {
+		_ = e.zstd.Close()
+	}
+}
+
+// shouldCompress decides if the file at path should be compressed according to the compression policy
+func (e *fileEncoder) shouldCompress(path string) bool {
+	switch e.policy {
+	case CompressAll:
+		return true
+	case CompressNone:
+		return false
+	default:
+		return isBinaryFile(path)
+	}
+}
+
+// encode compresses data with the codec of the encoder
+func (e *fileEncoder) encode(data []byte) ([]byte, error) {
+	switch e.codec {
+	case CodecGzip:
+		b := bytes.NewBuffer(make([]byte, 0, len(data)))
+		gz, err := gzip.NewWriterLevel(b, e.level)
+		if err != nil {
+			return nil, err
+		}
+		_, err = gz.Write(data)
+		if err != nil {
+			_ = gz.Close()
+			return nil, err
+		}
+		err = gz.Close()
+		if err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case CodecZstd:
+		return e.zstd.EncodeAll(data, make([]byte, 0, len(data))), nil
+	default:
+		return data, nil
+	}
+}
+
+func isBinaryFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	data := make([]byte, 512)
+	n, err := f.Read(data)
+	if err != nil {
+		return false
+	}
+	if http.DetectContentType(data[:n]) == "application/octet-stream" {
+		return true
+	}
+	return false
+}
+
+// fileDecoder decompresses embedded files while extracting. It is safe for concurrent use.
+type fileDecoder struct {
+	zstdDict []byte
+	zstdPool sync.Pool
+}
+
+func newFileDecoder(zstdDict []byte) *fileDecoder {
+	return &fileDecoder{zstdDict: zstdDict}
+}
+
+// open returns a reader for the decompressed contents of r. The reader must be closed, which does not close r.
+func (d *fileDecoder) open(codec Codec, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CodecNone:
+		return io.NopCloser(r), nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	case CodecZstd:
+		zr, _ := d.zstdPool.Get().(*zstd.Decoder)
+		if zr == nil {
+			// decoding happens in parallel per file already, so the decoder itself does not need to be concurrent
+			opts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true)}
+			if d.zstdDict != nil {
+				opts = append(opts, zstd.WithDecoderDicts(d.zstdDict))
+			}
+			var err error
+			zr, err = zstd.NewReader(nil, opts...)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err := zr.Reset(r)
+		if err != nil {
+			zr.Close()
+			return nil, err
+		}
+		return &pooledZstdReader{d: d, zr: zr}, nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %q", string(codec))
+	}
+}
+
+type pooledZstdReader struct {
+	d  *fileDecoder
+	zr *zstd.Decoder
+}
+
+func (r *pooledZstdReader) Read(p []byte) (int, error) {
+	return r.zr.Read(p)
+}
+
+func (r *pooledZstdReader) Close() error {
+	// releases the reference to the source
+	_ = r.zr.Reset(nil)
+	r.d.zstdPool.Put(r.zr)
+	return nil
+}
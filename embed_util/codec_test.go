@@ -0,0 +1,65 @@
+package embed_util
+
+import (
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/kluctl/go-embed-python/internal"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyForEmbedCodecs(t *testing.T) {
+	useTempCacheDir(t)
+	srcDir := t.TempDir()
+	src := []byte(strings.Repeat("def f():\n    return 1\n", 100))
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "mod.py"), src, 0o644))
+	// does not get smaller
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "tiny.txt"), []byte("x"), 0o644))
+
+	var samples [][]byte
+	for i := 0; i < 100; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("def f%d():\n    return %d\n", i, i)))
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{ID: 1, Contents: samples, History: src[:200]})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		opts []CopyOpt
+		ext  string
+	}{
+		{name: "text-not-compressed", ext: ""},
+		{name: "gzip", opts: []CopyOpt{WithCompressionPolicy(CompressAll)}, ext: ".gz"},
+		{name: "zstd", opts: []CopyOpt{WithCodec(CodecZstd), WithCompressionPolicy(CompressAll), WithCompressionLevel(3)}, ext: ".zst"},
+		{name: "zstd-dict", opts: []CopyOpt{WithCodec(CodecZstd), WithCompressionPolicy(CompressAll), WithZstdDictionary(dict)}, ext: ".zst"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			outDir := filepath.Join(t.TempDir(), "out")
+			err := CopyForEmbed(outDir, srcDir, tc.opts...)
+			assert.NoError(t, err)
+			assert.True(t, internal.Exists(filepath.Join(outDir, "mod.py"+tc.ext)))
+			assert.True(t, internal.Exists(filepath.Join(outDir, "tiny.txt")))
+
+			e, err := NewEmbeddedFiles(os.DirFS(outDir), fmt.Sprintf("test-codec-%d", rand.Uint32()))
+			assert.NoError(t, err)
+			defer e.Cleanup()
+
+			data, err := os.ReadFile(filepath.Join(e.GetExtractedPath(), "mod.py"))
+			assert.NoError(t, err)
+			assert.Equal(t, src, data)
+			data, err = os.ReadFile(filepath.Join(e.GetExtractedPath(), "tiny.txt"))
+			assert.NoError(t, err)
+			assert.Equal(t, "x", string(data))
+		})
+	}
+
+	err = CopyForEmbed(filepath.Join(t.TempDir(), "out"), srcDir, WithZstdDictionary(dict))
+	assert.Error(t, err)
+	err = CopyForEmbed(filepath.Join(t.TempDir(), "out"), srcDir, WithCodec("brotli"))
+	assert.Error(t, err)
+}
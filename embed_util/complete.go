@@ -0,0 +1,63 @@
+package embed_util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// completeMarkerSuffix is appended to the extraction directory for the file that records the hash of the file list
+// once all files were extracted. It is kept outside of the extraction directory, so that copies of the extracted
+// files, e.g. in virtual environments, don't contain it.
+const completeMarkerSuffix = ".complete"
+
+// stagingSuffix is appended to the extraction directory, followed by a random string, for staging directories
+const stagingSuffix = ".staging-"
+
+func completeMarkerPath(path string) string {
+	return path + completeMarkerSuffix
+}
+
+// isExtractionComplete returns true if the given extraction directory exists and has a completion marker for the
+// given hash
+func isExtractionComplete(path string, flHash string) (bool, error) {
+	_, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	b, err := os.ReadFile(completeMarkerPath(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return strings.TrimSpace(string(b)) == flHash, nil
+}
+
+func writeCompleteMarker(path string, flHash string) error {
+	return os.WriteFile(completeMarkerPath(path), []byte(flHash+"\n"), 0o644)
+}
+
+// removeStagingDirs removes the staging directories of the given extraction directory. The exclusive extraction lock
+// must be held.
+func removeStagingDirs(path string) error {
+	prefix := filepath.Base(path) + stagingSuffix
+	des, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	for _, de := range des {
+		if !strings.HasPrefix(de.Name(), prefix) {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(filepath.Dir(path), de.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,43 +1,149 @@
 package embed_util
 
 import (
-	"bytes"
-	"compress/gzip"
+	"errors"
 	"fmt"
 	"github.com/gofrs/flock"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 )
 
+// ErrNoFiles is returned when a nil fs.FS is passed, e.g. the Data variable that WriteFallbackEmbedGoFile generates for
+// platforms without embedded files.
+var ErrNoFiles = errors.New("no embedded files available")
+
 type EmbeddedFiles struct {
 	tmpDir        string
 	extractedPath string
+	zipImports    []string
+	fl            *fileList
+
+	// checkRoot is the default or shared directory below which the extraction directory is verified, see
+	// prepareExtractionPath. It is empty if extraction happens somewhere else, in which case nothing is verified.
+	checkRoot string
+
+	// usageLock is a shared lock on the usage lock file, which is held until Cleanup is called. It prevents GC from
+	// removing the extracted files while they are in use.
+	usageLock *flock.Flock
+}
+
+// VerifyMode controls how files left behind by a previous extraction are verified before being reused. Extraction
+// directories with a completion marker for the same contents are reused without looking at the files, unless
+// VerifyHash is used. The other modes only apply to directories without such a marker, e.g. from older versions or
+// when extracting without hash in the directory name.
+type VerifyMode int
+
+const (
+	// VerifySize reuses existing files if their type and size match. This is the default.
+	VerifySize VerifyMode = iota
+	// VerifyNone reuses all existing files without further checks.
+	VerifyNone
+	// VerifyHash re-hashes all existing files and compares them with the hashes recorded while packing, so that
+	// corrupted or tampered files are detected and replaced, even if the extraction was completed before. Files
+	// packed by older versions, which don't have hashes, are only verified by size.
+	VerifyHash
+)
+
+type embeddedFilesOptions struct {
+	autoGC     bool
+	verifyMode VerifyMode
+}
+
+type EmbeddedFilesOpt func(o *embeddedFilesOptions)
+
+// WithVerifyMode sets the mode used to verify existing files when extracting.
+func WithVerifyMode(mode VerifyMode) EmbeddedFilesOpt {
+	return func(o *embeddedFilesOptions) {
+		o.verifyMode = mode
+	}
+}
+
+// WithAutoGC causes stale extraction directories of other versions of the same embedded files to be removed after
+// extraction, see GC. Failures are only logged.
+func WithAutoGC() EmbeddedFilesOpt {
+	return func(o *embeddedFilesOptions) {
+		o.autoGC = true
+	}
 }
 
-func NewEmbeddedFiles(embedFs fs.FS, name string) (*EmbeddedFiles, error) {
-	tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("go-embedded-%s", name))
-	return NewEmbeddedFilesWithTmpDir(embedFs, tmpDir, true)
+func NewEmbeddedFiles(embedFs fs.FS, name string, opts ...EmbeddedFilesOpt) (*EmbeddedFiles, error) {
+	tmpDir := defaultTmpDir(name)
+	e, err := NewEmbeddedFilesWithTmpDir(embedFs, tmpDir, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var o embeddedFilesOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	// directories left behind in the shared temporary directory by older versions, see GC
+	if legacy := legacyTmpDir(name); o.autoGC && legacy != tmpDir {
+		err = GCWithTmpDir(legacy)
+		if err != nil {
+			log.Warningf("failed to remove stale extraction directories of %s: %v", legacy, err)
+		}
+	}
+	return e, nil
 }
 
-func NewEmbeddedFilesWithTmpDir(embedFs fs.FS, tmpDir string, withHashInDir bool) (*EmbeddedFiles, error) {
+// NewEmbeddedFilesWithTmpDir is like NewEmbeddedFiles, but extracts into tmpDir. The ownership and permission checks
+// described for SecurityError are only done if tmpDir is inside the user's cache directory or a shared temporary
+// directory, as other locations are expected to be managed by the caller.
+func NewEmbeddedFilesWithTmpDir(embedFs fs.FS, tmpDir string, withHashInDir bool, opts ...EmbeddedFilesOpt) (*EmbeddedFiles, error) {
+	var o embeddedFilesOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	e := &EmbeddedFiles{
-		tmpDir: tmpDir,
+		tmpDir:    tmpDir,
+		checkRoot: trustRoot(tmpDir),
 	}
-	err := e.extract(embedFs, withHashInDir)
+	flHash, err := e.extract(embedFs, withHashInDir, o.verifyMode)
 	if err != nil {
 		return nil, err
 	}
+
+	if o.autoGC && withHashInDir {
+		err = GCWithTmpDir(tmpDir, flHash)
+		if err != nil {
+			log.Warningf("failed to remove stale extraction directories of %s: %v", tmpDir, err)
+		}
+	}
 	return e, nil
 }
 
+// Cleanup releases the extracted files and removes them, unless these are still in use by someone else. The same
+// extraction directory is shared by all EmbeddedFiles with the same name and contents, including those of other
+// processes, and by processes that called RegisterUsage. Files that are kept are removed later by whoever is last
+// to call Cleanup, or by GC if they became stale.
 func (e *EmbeddedFiles) Cleanup() error {
 	if e.extractedPath == "" {
 		return nil
 	}
-	err := os.RemoveAll(e.extractedPath)
+	path := e.extractedPath
 	e.extractedPath = ""
+	if e.usageLock != nil {
+		_ = e.usageLock.Close()
+		e.usageLock = nil
+	}
+	return removeUnusedDir(path)
+}
+
+// Release releases the usage of the extracted files without removing them, so that they can be reused by the next
+// extraction with the same name and contents. Use GC to remove them once they are not needed anymore.
+func (e *EmbeddedFiles) Release() error {
+	e.extractedPath = ""
+	if e.usageLock == nil {
+		return nil
+	}
+	err := e.usageLock.Close()
+	e.usageLock = nil
 	return err
 }
 
@@ -45,45 +151,202 @@ func (e *EmbeddedFiles) GetExtractedPath() string {
 	return e.extractedPath
 }
 
-func (e *EmbeddedFiles) extract(embedFs fs.FS, withHashInDir bool) error {
-	fl, err := e.readOrBuildFileList(embedFs)
+// GetZipImportPaths returns the absolute paths of all zip files that were created via WithZipImport while packing.
+// These must be added to the Python path.
+func (e *EmbeddedFiles) GetZipImportPaths() []string {
+	var ret []string
+	for _, p := range e.zipImports {
+		ret = append(ret, filepath.Join(e.extractedPath, p))
+	}
+	return ret
+}
+
+// FilesHash returns the hash that identifies the contents of the given embedded files. It is the same hash that is
+// appended to the extraction directory.
+func FilesHash(embedFs fs.FS) (string, error) {
+	fl, err := readOrBuildFileList(embedFs)
 	if err != nil {
-		return err
+		return "", err
+	}
+	return fl.Hash(), nil
+}
+
+func (e *EmbeddedFiles) extract(embedFs fs.FS, withHashInDir bool, verifyMode VerifyMode) (string, error) {
+	fl, err := readOrBuildFileList(embedFs)
+	if err != nil {
+		return "", err
 	}
 
 	flHash := fl.Hash()
+	e.fl = fl
+	e.zipImports = fl.ZipImports
 
 	if withHashInDir {
-		e.extractedPath = fmt.Sprintf("%s-%s", e.tmpDir, flHash[:16])
+		e.extractedPath = fmt.Sprintf("%s-%s", e.tmpDir, flHash[:dirHashLen])
 	} else {
 		e.extractedPath = e.tmpDir
 	}
-	err = os.MkdirAll(filepath.Dir(e.extractedPath), 0o755)
+	err = prepareExtractionPath(e.checkRoot, e.extractedPath)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	lock := flock.New(e.extractedPath + ".lock")
-	err = lock.Lock()
+	if verifyMode != VerifyHash {
+		reused, err := e.reuseCompleted(flHash)
+		if err != nil {
+			return "", err
+		}
+		if reused {
+			return flHash, nil
+		}
+	}
+
+	lock, err := lockFile(e.extractedPath+".lock", true)
 	if err != nil {
-		return err
+		return "", err
+	}
+	defer lock.Close()
+	// somebody else might have created the lock file after it was checked
+	err = e.checkOwned(e.extractedPath + ".lock")
+	if err != nil {
+		return "", err
+	}
+
+	// somebody else might have completed the extraction while we were waiting for the lock
+	complete, err := isExtractionComplete(e.extractedPath, flHash)
+	if err != nil {
+		return "", err
+	}
+	if !complete || verifyMode == VerifyHash {
+		err = e.doExtract(embedFs, fl, flHash, verifyMode)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// acquired while still holding the extraction lock, so that GC can't remove the files in between
+	err = e.acquireUsageLock()
+	if err != nil {
+		return "", err
+	}
+
+	return flHash, nil
+}
+
+// reuseCompleted checks the completion marker of an existing extraction directory under a shared lock and acquires
+// the usage lock if it is complete, so that starting with already extracted files does not need to touch every file.
+func (e *EmbeddedFiles) reuseCompleted(flHash string) (bool, error) {
+	lock, err := lockFile(e.extractedPath+".lock", false)
+	if err != nil {
+		return false, err
 	}
 	defer lock.Close()
+	err = e.checkOwned(e.extractedPath + ".lock")
+	if err != nil {
+		return false, err
+	}
+
+	complete, err := isExtractionComplete(e.extractedPath, flHash)
+	if err != nil || !complete {
+		return false, err
+	}
+	err = e.acquireUsageLock()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkOwned verifies an extraction directory or lock file, unless extraction happens outside of the default and
+// shared locations
+func (e *EmbeddedFiles) checkOwned(path string) error {
+	if e.checkRoot == "" {
+		return nil
+	}
+	return checkOwnedPath(path)
+}
 
-	err = os.MkdirAll(e.extractedPath, 0o755)
+func (e *EmbeddedFiles) acquireUsageLock() error {
+	// somebody else might have created the directory after it was checked
+	err := e.checkOwned(e.extractedPath)
+	if err != nil {
+		return err
+	}
+	usageLock, err := lockFile(usageLockPath(e.extractedPath), false)
+	if err != nil {
+		return err
+	}
+	err = e.checkOwned(usageLockPath(e.extractedPath))
 	if err != nil {
+		_ = usageLock.Close()
 		return err
 	}
+	e.usageLock = usageLock
+	return nil
+}
 
-	err = e.copyEmbeddedFilesToTmp(embedFs, fl)
+// doExtract must be called while holding the exclusive extraction lock. New extraction directories are populated
+// in a staging directory next to the final location, which is then renamed into place, so that a crash never leaves
+// a partially extracted directory behind. Existing directories, e.g. from versions that did not write a completion
+// marker yet or when extracting without hash in the directory name, are updated in place instead, as these might
+// be in use. In both cases, the completion marker is written last.
+func (e *EmbeddedFiles) doExtract(embedFs fs.FS, fl *fileList, flHash string, verifyMode VerifyMode) error {
+	// left behind by crashed extractions, nobody else can be using these while we hold the lock
+	err := removeStagingDirs(e.extractedPath)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	_, err = os.Lstat(e.extractedPath)
+	if err == nil {
+		err = os.Remove(completeMarkerPath(e.extractedPath))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = e.copyEmbeddedFilesToTmp(embedFs, fl, e.extractedPath, verifyMode)
+		if err != nil {
+			return err
+		}
+		return writeCompleteMarker(e.extractedPath, flHash)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	stagingDir, err := os.MkdirTemp(filepath.Dir(e.extractedPath), filepath.Base(e.extractedPath)+stagingSuffix)
+	if err != nil {
+		return err
+	}
+	err = e.populateStagingDir(embedFs, fl, stagingDir, verifyMode)
+	if err == nil {
+		// might be left behind if the directory was removed by someone else
+		err = os.Remove(completeMarkerPath(e.extractedPath))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(stagingDir, e.extractedPath)
+	}
+	if err != nil {
+		_ = os.RemoveAll(stagingDir)
+		return err
+	}
+	return writeCompleteMarker(e.extractedPath, flHash)
+}
+
+func (e *EmbeddedFiles) populateStagingDir(embedFs fs.FS, fl *fileList, stagingDir string, verifyMode VerifyMode) error {
+	// MkdirTemp creates the directory with 0o700
+	err := os.Chmod(stagingDir, 0o755)
+	if err != nil {
+		return err
+	}
+	return e.copyEmbeddedFilesToTmp(embedFs, fl, stagingDir, verifyMode)
 }
 
-func (e *EmbeddedFiles) readOrBuildFileList(embedFs fs.FS) (*fileList, error) {
+func readOrBuildFileList(embedFs fs.FS) (*fileList, error) {
+	if embedFs == nil {
+		return nil, ErrNoFiles
+	}
 	flStr, err := fs.ReadFile(embedFs, "files.json")
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -99,85 +362,195 @@ func (e *EmbeddedFiles) readOrBuildFileList(embedFs fs.FS) (*fileList, error) {
 	return fl, nil
 }
 
-func (e *EmbeddedFiles) copyEmbeddedFilesToTmp(embedFs fs.FS, fl *fileList) error {
-	m := make(map[string]fileListEntry)
-
-	for _, fle := range fl.Files {
-		m[fle.Name] = fle
+// resolveEntry follows symlinks, which are extracted as copies of the files they point to
+func resolveEntry(m map[string]fileListEntry, fle fileListEntry) (fileListEntry, error) {
+	resolvedFle := fle
+	for resolvedFle.Mode.Type() == fs.ModeSymlink {
+		if filepath.IsAbs(resolvedFle.Symlink) {
+			return fileListEntry{}, fmt.Errorf("abs path not allowed: %s", resolvedFle.Symlink)
+		}
+		sl := filepath.Clean(filepath.Join(filepath.Dir(resolvedFle.Name), resolvedFle.Symlink))
+		fle2, ok := m[sl]
+		if !ok {
+			return fileListEntry{}, fmt.Errorf("symlink %s at %s could not be resolved", resolvedFle.Symlink, resolvedFle.Name)
+		}
+		resolvedFle = fle2
+		if resolvedFle.Mode.IsDir() {
+			return fileListEntry{}, fmt.Errorf("symlinked dirs not supported at the moment: %s -> %s", fle.Name, resolvedFle.Name)
+		}
 	}
+	return resolvedFle, nil
+}
 
-	for _, fle := range fl.Files {
-		resolvedFle := fle
-		for resolvedFle.Mode.Type() == fs.ModeSymlink {
-			if filepath.IsAbs(resolvedFle.Symlink) {
-				return fmt.Errorf("abs path not allowed: %s", resolvedFle.Symlink)
-			}
-			sl := filepath.Clean(filepath.Join(filepath.Dir(resolvedFle.Name), resolvedFle.Symlink))
-			fle2, ok := m[sl]
-			if !ok {
-				return fmt.Errorf("symlink %s at %s could not be resolved", resolvedFle.Symlink, resolvedFle.Name)
-			}
-			resolvedFle = fle2
-			if resolvedFle.Mode.IsDir() {
-				return fmt.Errorf("symlinked dirs not supported at the moment: %s -> %s", fle.Name, resolvedFle.Name)
-			}
+// isUnchanged checks if the existing file at path matches the given (resolved) entry
+func isUnchanged(path string, existingSt fs.FileInfo, resolvedFle fileListEntry, verifyMode VerifyMode) (bool, error) {
+	if resolvedFle.Mode.Type() != existingSt.Mode().Type() {
+		return false, nil
+	}
+	if resolvedFle.Mode.IsDir() || verifyMode == VerifyNone {
+		return true, nil
+	}
+	if existingSt.Size() != resolvedFle.Size {
+		return false, nil
+	}
+	if verifyMode == VerifyHash && resolvedFle.Sha256 != "" && resolvedFle.Mode.IsRegular() {
+		h, err := fileSha256(path)
+		if err != nil {
+			return false, err
 		}
+		return h == resolvedFle.Sha256, nil
+	}
+	return true, nil
+}
 
-		path := filepath.Join(e.extractedPath, fle.Name)
-		existingSt, err := os.Lstat(path)
-		if err == nil {
-			if resolvedFle.Mode.Type() == existingSt.Mode().Type() {
-				if resolvedFle.Mode.IsDir() {
-					continue
-				} else if existingSt.Size() == resolvedFle.Size {
-					// unchanged
-					continue
-				}
-			}
-			err = os.RemoveAll(path)
-			if err != nil {
-				return err
-			}
-		}
+// copyEmbeddedFilesToTmp extracts all files that don't exist yet or have changed into dir. Directories are created
+// first, in order, and then the files are extracted in parallel.
+func (e *EmbeddedFiles) copyEmbeddedFilesToTmp(embedFs fs.FS, fl *fileList, dir string, verifyMode VerifyMode) error {
+	m := fl.toMap()
 
-		if fle.Mode.IsDir() {
-			err := os.MkdirAll(path, resolvedFle.Mode.Perm())
-			if err != nil {
-				return err
-			}
-			continue
-		} else if !resolvedFle.Mode.IsRegular() {
-			continue
+	var zstdDict []byte
+	if fl.ZstdDict != "" {
+		var err error
+		zstdDict, err = fs.ReadFile(embedFs, fl.ZstdDict)
+		if err != nil {
+			return err
 		}
+	}
+	dec := newFileDecoder(zstdDict)
 
-		var data []byte
+	var g errgroup.Group
+	g.SetLimit(maxParallelFiles)
 
-		if resolvedFle.Compressed {
-			data, err = fs.ReadFile(embedFs, resolvedFle.Name+".gz")
-			if err != nil {
-				return err
-			}
-			gz, err := gzip.NewReader(bytes.NewReader(data))
-			if err != nil {
-				return err
-			}
-			data, err = io.ReadAll(gz)
-			_ = gz.Close()
+	var files []fileListEntry
+	for _, fle := range fl.Files {
+		if fle.Mode.IsDir() {
+			err := syncEmbeddedFile(embedFs, dec, m, fle, dir, verifyMode)
 			if err != nil {
 				return err
 			}
 		} else {
-			data, err = fs.ReadFile(embedFs, resolvedFle.Name)
-			if err != nil {
-				return err
-			}
+			files = append(files, fle)
 		}
+	}
+	for _, fle := range files {
+		fle := fle
+		g.Go(func() error {
+			return syncEmbeddedFile(embedFs, dec, m, fle, dir, verifyMode)
+		})
+	}
+	return g.Wait()
+}
 
-		err = os.WriteFile(path, data, resolvedFle.Mode.Perm())
+// syncEmbeddedFile extracts a single entry into dir, unless it exists already and is unchanged
+func syncEmbeddedFile(embedFs fs.FS, dec *fileDecoder, m map[string]fileListEntry, fle fileListEntry, dir string, verifyMode VerifyMode) error {
+	resolvedFle, err := resolveEntry(m, fle)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, fle.Name)
+	existingSt, err := os.Lstat(path)
+	if err == nil {
+		unchanged, err := isUnchanged(path, existingSt, resolvedFle, verifyMode)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			return nil
+		}
+		err = os.RemoveAll(path)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	if fle.Mode.IsDir() {
+		return os.MkdirAll(path, resolvedFle.Mode.Perm())
+	} else if !resolvedFle.Mode.IsRegular() {
+		return nil
+	}
+	return extractEmbeddedFile(embedFs, dec, resolvedFle, path)
+}
+
+// extractEmbeddedFile streams the contents of the given (resolved) entry to path, decompressing on the fly
+func extractEmbeddedFile(embedFs fs.FS, dec *fileDecoder, resolvedFle fileListEntry, path string) error {
+	codec := resolvedFle.codec()
+	ext, err := codec.extension()
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %w", resolvedFle.Name, err)
+	}
+	srcName := resolvedFle.Name + ext
+	src, err := embedFs.Open(srcName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	r, err := dec.open(codec, src)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", srcName, err)
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, resolvedFle.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to extract %s: %w", resolvedFle.Name, err)
+	}
+	return f.Close()
+}
+
+// VerifyReport is returned by EmbeddedFiles.Verify.
+type VerifyReport struct {
+	// Missing contains the paths of files that don't exist anymore, relative to the extraction directory.
+	Missing []string
+	// Mismatched contains the paths of files that exist but have a different type, size or hash.
+	Mismatched []string
+}
+
+// OK returns true if no problems were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Mismatched) == 0
+}
+
+// Verify compares all extracted files with the embedded files, using their hashes if available. Problems are not
+// repaired, which requires extracting again via NewEmbeddedFiles with VerifyHash.
+func (e *EmbeddedFiles) Verify() (*VerifyReport, error) {
+	if e.extractedPath == "" {
+		return nil, fmt.Errorf("embedded files have been cleaned up already")
+	}
+
+	m := e.fl.toMap()
+	report := &VerifyReport{}
+	for _, fle := range e.fl.Files {
+		resolvedFle, err := resolveEntry(m, fle)
+		if err != nil {
+			return nil, err
+		}
+		if !resolvedFle.Mode.IsDir() && !resolvedFle.Mode.IsRegular() {
+			continue
+		}
+
+		path := filepath.Join(e.extractedPath, fle.Name)
+		existingSt, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				report.Missing = append(report.Missing, fle.Name)
+				continue
+			}
+			return nil, err
+		}
+		unchanged, err := isUnchanged(path, existingSt, resolvedFle, VerifyHash)
+		if err != nil {
+			return nil, err
+		}
+		if !unchanged {
+			report.Mismatched = append(report.Mismatched, fle.Name)
+		}
+	}
+	return report, nil
 }
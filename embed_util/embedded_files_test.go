@@ -0,0 +1,173 @@
+package embed_util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/kluctl/go-embed-python/internal"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"testing/fstest"
+)
+
+// useTempCacheDir points os.UserCacheDir to a temporary directory, so that the default extraction location of
+// NewEmbeddedFiles and GC is isolated from the real cache directory
+func useTempCacheDir(t *testing.T) {
+	t.Setenv(internal.CacheDirEnv(), t.TempDir())
+}
+
+func TestVerify(t *testing.T) {
+	useTempCacheDir(t)
+	name := fmt.Sprintf("test-verify-%d", rand.Uint32())
+	fsys := fstest.MapFS{
+		"a.py":     &fstest.MapFile{Data: []byte("x = 1\n"), Mode: 0o644},
+		"pkg/b.py": &fstest.MapFile{Data: []byte("y = 2\n"), Mode: 0o644},
+	}
+
+	e, err := NewEmbeddedFiles(fsys, name)
+	assert.NoError(t, err)
+	defer e.Cleanup()
+
+	report, err := e.Verify()
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+
+	// same size, different content
+	aPath := filepath.Join(e.GetExtractedPath(), "a.py")
+	assert.NoError(t, os.WriteFile(aPath, []byte("x = 3\n"), 0o644))
+	assert.NoError(t, os.Remove(filepath.Join(e.GetExtractedPath(), "pkg", "b.py")))
+
+	report, err = e.Verify()
+	assert.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, []string{"a.py"}, report.Mismatched)
+	assert.Equal(t, []string{filepath.Join("pkg", "b.py")}, report.Missing)
+
+	// the extraction was completed before, so the files are not looked at
+	e2, err := NewEmbeddedFiles(fsys, name)
+	assert.NoError(t, err)
+	defer e2.Cleanup()
+	report, err = e2.Verify()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join("pkg", "b.py")}, report.Missing)
+	assert.Equal(t, []string{"a.py"}, report.Mismatched)
+
+	e3, err := NewEmbeddedFiles(fsys, name, WithVerifyMode(VerifyHash))
+	assert.NoError(t, err)
+	defer e3.Cleanup()
+	report, err = e3.Verify()
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	data, err := os.ReadFile(aPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "x = 1\n", string(data))
+}
+
+func TestInterruptedExtraction(t *testing.T) {
+	useTempCacheDir(t)
+	name := fmt.Sprintf("test-interrupted-%d", rand.Uint32())
+	fsys := fstest.MapFS{
+		"a.py":     &fstest.MapFile{Data: []byte("x = 1\n"), Mode: 0o644},
+		"pkg/b.py": &fstest.MapFile{Data: []byte("y = 2\n"), Mode: 0o644},
+	}
+
+	e, err := NewEmbeddedFiles(fsys, name)
+	assert.NoError(t, err)
+	path := e.GetExtractedPath()
+	assert.True(t, internal.Exists(path+".complete"))
+	assert.NoError(t, e.Cleanup())
+	assert.False(t, internal.Exists(path))
+	assert.False(t, internal.Exists(path+".complete"))
+
+	// a crash in the middle of extracting in place (as done by older versions) and of populating a staging directory
+	assert.NoError(t, os.MkdirAll(path, 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(path, "a.py"), []byte("x = 1\n"), 0o644))
+	stagingDir := path + ".staging-123"
+	assert.NoError(t, os.MkdirAll(filepath.Join(stagingDir, "pkg"), 0o755))
+
+	e2, err := NewEmbeddedFiles(fsys, name)
+	assert.NoError(t, err)
+	defer e2.Cleanup()
+	assert.Equal(t, path, e2.GetExtractedPath())
+	assert.False(t, internal.Exists(stagingDir))
+	assert.True(t, internal.Exists(path+".complete"))
+	report, err := e2.Verify()
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+}
+
+func TestParallelExtraction(t *testing.T) {
+	useTempCacheDir(t)
+	srcDir := t.TempDir()
+	// detected as binary, so it is compressed
+	bigData := bytes.Repeat([]byte{0, 1, 2, 3, 4, 5, 6, 7}, 1024*1024)
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "big.bin"), bigData, 0o755))
+	for i := 0; i < 100; i++ {
+		dir := filepath.Join(srcDir, fmt.Sprintf("pkg%d", i%10))
+		assert.NoError(t, os.MkdirAll(dir, 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("m%d.py", i)), []byte(fmt.Sprintf("x = %d\n", i)), 0o644))
+	}
+
+	outDir := filepath.Join(t.TempDir(), "out")
+	err := CopyForEmbed(outDir, srcDir)
+	assert.NoError(t, err)
+	assert.True(t, internal.Exists(filepath.Join(outDir, "big.bin.gz")))
+
+	e, err := NewEmbeddedFiles(os.DirFS(outDir), fmt.Sprintf("test-parallel-%d", rand.Uint32()))
+	assert.NoError(t, err)
+	defer e.Cleanup()
+
+	data, err := os.ReadFile(filepath.Join(e.GetExtractedPath(), "big.bin"))
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(bigData, data))
+	if runtime.GOOS != "windows" {
+		st, err := os.Stat(filepath.Join(e.GetExtractedPath(), "big.bin"))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o755), st.Mode().Perm())
+	}
+	data, err = os.ReadFile(filepath.Join(e.GetExtractedPath(), "pkg7", "m57.py"))
+	assert.NoError(t, err)
+	assert.Equal(t, "x = 57\n", string(data))
+
+	report, err := e.Verify()
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+}
+
+func TestLegacyCompressed(t *testing.T) {
+	useTempCacheDir(t)
+	b := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(b)
+	_, err := gz.Write([]byte("x = 1\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+
+	// as written by older versions, which only knew about gzip
+	fsys := fstest.MapFS{
+		"files.json": &fstest.MapFile{Data: []byte(`{"contentHash": "legacy", "files": [{"name": "a.py", "size": 6, "perm": 420, "compressed": true}]}`)},
+		"a.py.gz":    &fstest.MapFile{Data: b.Bytes()},
+	}
+	e, err := NewEmbeddedFiles(fsys, fmt.Sprintf("test-legacy-%d", rand.Uint32()))
+	assert.NoError(t, err)
+	defer e.Cleanup()
+
+	data, err := os.ReadFile(filepath.Join(e.GetExtractedPath(), "a.py"))
+	assert.NoError(t, err)
+	assert.Equal(t, "x = 1\n", string(data))
+}
+
+func TestNilFS(t *testing.T) {
+	useTempCacheDir(t)
+
+	// the Data variable written by WriteFallbackEmbedGoFile
+	var data fs.FS
+	_, err := FilesHash(data)
+	assert.ErrorIs(t, err, ErrNoFiles)
+	_, err = NewEmbeddedFiles(data, fmt.Sprintf("test-nil-%d", rand.Uint32()))
+	assert.ErrorIs(t, err, ErrNoFiles)
+}
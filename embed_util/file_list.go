@@ -5,8 +5,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
-	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
@@ -15,14 +15,46 @@ import (
 type fileList struct {
 	ContentHash string          `json:"contentHash"`
 	Files       []fileListEntry `json:"files"`
+	// ZipImports contains the zip files that must be added to the Python path, see WithZipImport
+	ZipImports []string `json:"zipImports,omitempty"`
+	// ZstdDict is the name of the embedded file containing the dictionary used by zstd compressed files, see
+	// WithZstdDictionary
+	ZstdDict string `json:"zstdDict,omitempty"`
 }
 
 type fileListEntry struct {
-	Name       string      `json:"name"`
-	Size       int64       `json:"size"`
-	Mode       fs.FileMode `json:"perm"`
-	Symlink    string      `json:"symlink,omitempty"`
-	Compressed bool        `json:"compressed,omitempty"`
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"perm"`
+	Symlink string      `json:"symlink,omitempty"`
+	// Codec is the codec the file was compressed with. The embedded file has the extension of the codec appended.
+	Codec Codec `json:"codec,omitempty"`
+	// Compressed is set instead of Codec by older versions, in which case the file is gzip compressed
+	Compressed bool `json:"compressed,omitempty"`
+	// Sha256 is the hash of the uncompressed contents of regular files. It is missing in file lists written by older
+	// versions.
+	Sha256 string `json:"sha256,omitempty"`
+
+	// srcPath overrides the source path of entries that are generated while packing
+	srcPath string
+}
+
+// codec returns the codec of the embedded file, taking file lists written by older versions into account
+func (fle *fileListEntry) codec() Codec {
+	if fle.Codec != "" {
+		return fle.Codec
+	}
+	if fle.Compressed {
+		return CodecGzip
+	}
+	return CodecNone
+}
+
+func (fle *fileListEntry) sourcePath(dir string) string {
+	if fle.srcPath != "" {
+		return fle.srcPath
+	}
+	return filepath.Join(dir, fle.Name)
 }
 
 func readFileList(fileListStr string) (*fileList, error) {
@@ -62,8 +94,6 @@ func buildFileListFromDir(dir string) (*fileList, error) {
 			fle.Mode &= ^fs.ModePerm
 		} else if info.Mode().IsDir() {
 			fle.Size = 0
-		} else if info.Mode().IsRegular() {
-			fle.Compressed = shouldCompress(path)
 		}
 
 		fl.Files = append(fl.Files, fle)
@@ -101,6 +131,16 @@ func buildFileListFromFs(embedFs fs.FS) (*fileList, error) {
 			return fmt.Errorf("symlink not supported in buildFileListFromFs")
 		} else if info.Mode().IsDir() {
 			fle.Size = 0
+		} else if info.Mode().IsRegular() {
+			f, err := embedFs.Open(path)
+			if err != nil {
+				return err
+			}
+			fle.Sha256, err = readerSha256(f)
+			_ = f.Close()
+			if err != nil {
+				return err
+			}
 		}
 
 		fl.Files = append(fl.Files, fle)
@@ -115,21 +155,37 @@ func buildFileListFromFs(embedFs fs.FS) (*fileList, error) {
 	return &fl, nil
 }
 
-func shouldCompress(path string) bool {
+func (fl *fileList) fillHashes(dir string) error {
+	for i := range fl.Files {
+		fle := &fl.Files[i]
+		if !fle.Mode.IsRegular() {
+			continue
+		}
+		var err error
+		fle.Sha256, err = fileSha256(fle.sourcePath(dir))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileSha256(path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return false
+		return "", err
 	}
 	defer f.Close()
-	data := make([]byte, 512)
-	n, err := f.Read(data)
+	return readerSha256(f)
+}
+
+func readerSha256(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
 	if err != nil {
-		return false
-	}
-	if http.DetectContentType(data[:n]) == "application/octet-stream" {
-		return true
+		return "", err
 	}
-	return false
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 func (fl *fileList) toMap() map[string]fileListEntry {
@@ -0,0 +1,89 @@
+package embed_util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dirHashLen is the length of the hash suffix appended to extraction directories
+const dirHashLen = 16
+
+// GC removes stale extraction directories of the embedded files with the given name, i.e. directories that were
+// created by NewEmbeddedFiles with the same name but for different contents, e.g. by older versions of the
+// application. keep contains the hashes (see FilesHash) of directories that must not be removed.
+//
+// Directories that are still in use by a live process are never removed, as every EmbeddedFiles instance holds a
+// shared lock on the usage lock file of its directory until Cleanup is called. Please note that versions of this
+// library that did not have GC yet don't hold such a lock, so their directories might be removed while in use.
+//
+// Stale directories in the shared temporary directory, where older versions of this library extracted to, are
+// removed as well.
+func GC(name string, keep ...string) error {
+	tmpDir := defaultTmpDir(name)
+	err := GCWithTmpDir(tmpDir, keep...)
+	if legacy := legacyTmpDir(name); legacy != tmpDir {
+		err = errors.Join(err, GCWithTmpDir(legacy, keep...))
+	}
+	return err
+}
+
+// GCWithTmpDir is like GC, but for directories created by NewEmbeddedFilesWithTmpDir with withHashInDir set.
+func GCWithTmpDir(tmpDir string, keep ...string) error {
+	keepMap := map[string]bool{}
+	for _, h := range keep {
+		if len(h) > dirHashLen {
+			h = h[:dirHashLen]
+		}
+		keepMap[h] = true
+	}
+
+	parent := filepath.Dir(tmpDir)
+	prefix := filepath.Base(tmpDir) + "-"
+	des, err := os.ReadDir(parent)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	stale := map[string]bool{}
+	for _, de := range des {
+		name := de.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		// lock files and completion markers without a directory are removed as well
+		hash := strings.TrimPrefix(name, prefix)
+		for _, suffix := range []string{".usage.lock", ".lock", completeMarkerSuffix} {
+			hash = strings.TrimSuffix(hash, suffix)
+		}
+		if !isDirHash(hash) || keepMap[hash] {
+			continue
+		}
+		stale[filepath.Join(parent, prefix+hash)] = true
+	}
+
+	var errs []error
+	for p := range stale {
+		err = removeUnusedDir(p)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func isDirHash(s string) bool {
+	if len(s) != dirHashLen {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
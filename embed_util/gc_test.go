@@ -0,0 +1,81 @@
+package embed_util
+
+import (
+	"fmt"
+	"github.com/kluctl/go-embed-python/internal"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestGC(t *testing.T) {
+	useTempCacheDir(t)
+	t.Setenv("TMPDIR", t.TempDir())
+	name := fmt.Sprintf("test-gc-%d", rand.Uint32())
+	tmpDir := defaultTmpDir(name)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(tmpDir), 0o755))
+
+	fs1 := fstest.MapFS{"mymod.py": &fstest.MapFile{Data: []byte("x = 1\n"), Mode: 0o644}}
+	fs2 := fstest.MapFS{"mymod.py": &fstest.MapFile{Data: []byte("x = 22\n"), Mode: 0o644}}
+
+	// left behind by an older version that has exited
+	stalePath := tmpDir + "-0123456789abcdef"
+	assert.NoError(t, os.MkdirAll(stalePath, 0o755))
+	assert.NoError(t, os.WriteFile(stalePath+".lock", nil, 0o644))
+	orphanedLock := tmpDir + "-fedcba9876543210.lock"
+	assert.NoError(t, os.WriteFile(orphanedLock, nil, 0o644))
+	orphanedMarker := tmpDir + "-fedcba9876543211.complete"
+	assert.NoError(t, os.WriteFile(orphanedMarker, nil, 0o644))
+	// left behind in the shared temporary directory, where older versions extracted to
+	legacyPath := legacyTmpDir(name) + "-00112233445566ff"
+	assert.NoError(t, os.MkdirAll(legacyPath, 0o755))
+
+	e1, err := NewEmbeddedFiles(fs1, name)
+	assert.NoError(t, err)
+	defer e1.Cleanup()
+
+	e2, err := NewEmbeddedFiles(fs2, name, WithAutoGC())
+	assert.NoError(t, err)
+	defer e2.Cleanup()
+
+	assert.False(t, internal.Exists(stalePath))
+	assert.False(t, internal.Exists(stalePath+".lock"))
+	assert.False(t, internal.Exists(orphanedLock))
+	assert.False(t, internal.Exists(orphanedMarker))
+	assert.False(t, internal.Exists(legacyPath))
+	// still in use
+	assert.True(t, internal.Exists(e1.GetExtractedPath()))
+	assert.True(t, internal.Exists(e2.GetExtractedPath()))
+
+	hash2, err := FilesHash(fs2)
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(legacyPath, 0o755))
+	assert.NoError(t, GC(name, hash2))
+	assert.True(t, internal.Exists(e1.GetExtractedPath()))
+	assert.False(t, internal.Exists(legacyPath))
+
+	// e.g. a child process that outlives us
+	e1Path := e1.GetExtractedPath()
+	u, err := RegisterUsage(e1Path)
+	assert.NoError(t, err)
+	assert.NoError(t, e1.Cleanup())
+	assert.True(t, internal.Exists(e1Path))
+	assert.NoError(t, GC(name, hash2))
+	assert.True(t, internal.Exists(e1Path))
+
+	assert.NoError(t, u.Release())
+	assert.NoError(t, GC(name, hash2))
+	assert.False(t, internal.Exists(e1Path))
+	assert.False(t, internal.Exists(e1Path+".lock"))
+	assert.True(t, internal.Exists(e2.GetExtractedPath()))
+
+	// extracting again after GC removed the lock files
+	e1, err = NewEmbeddedFiles(fs1, name)
+	assert.NoError(t, err)
+	assert.Equal(t, e1Path, e1.GetExtractedPath())
+	assert.True(t, internal.Exists(filepath.Join(e1Path, "mymod.py")))
+	assert.NoError(t, e1.Cleanup())
+}
@@ -1,8 +1,6 @@
 package embed_util
 
 import (
-	"bytes"
-	"compress/gzip"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -12,21 +10,133 @@ import (
 	"golang.org/x/sync/errgroup"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
-func CopyForEmbed(out string, dir string) error {
+type copyOptions struct {
+	zipImports       []zipImport
+	compilePythonExe string
+
+	codec             Codec
+	compressionPolicy CompressionPolicy
+	compressionLevel  int
+	zstdDict          []byte
+}
+
+type CopyOpt func(o *copyOptions)
+
+// WithZipImport causes all pure-Python modules and packages found directly inside root to be packed into a single
+// zip file at zipName, instead of being embedded file by file. Both paths are relative to the directory being packed.
+// Packages that contain anything other than .py files are embedded as usual.
+//
+// The zip file is served via Python's zipimport at runtime, which avoids extracting thousands of small files. The
+// zip file must be added to the Python path, see EmbeddedFiles.GetZipImportPaths. For the Python standard library,
+// the zip file should be named lib/pythonXY.zip (or pythonXY.zip on Windows), which is on the default path.
+func WithZipImport(root string, zipName string) CopyOpt {
+	return func(o *copyOptions) {
+		o.zipImports = append(o.zipImports, zipImport{root: root, zipName: zipName})
+	}
+}
+
+// WithCompileBytecode compiles all .py files to .pyc files with the given interpreter, so that they don't have to be
+// compiled at runtime on first import. The .pyc files use the unchecked-hash invalidation mode, which makes them
+// reproducible and independent of the modification times of the extracted files.
+//
+// Bytecode is specific to the Python version, so the interpreter must be of the same version as the one that is used
+// at runtime. In practice, this means that bytecode can only be compiled for the platform that packing runs on.
+// Combined with WithZipImport, the .pyc files are stored in the zip file as well.
+func WithCompileBytecode(pythonExe string) CopyOpt {
+	return func(o *copyOptions) {
+		o.compilePythonExe = pythonExe
+	}
+}
+
+// WithCodec sets the codec used for compressed files. Defaults to CodecGzip.
+func WithCodec(codec Codec) CopyOpt {
+	return func(o *copyOptions) {
+		o.codec = codec
+	}
+}
+
+// WithCompressionPolicy sets the policy that decides which files are compressed. Defaults to CompressBinary. Files
+// that don't get smaller are always stored uncompressed.
+func WithCompressionPolicy(policy CompressionPolicy) CopyOpt {
+	return func(o *copyOptions) {
+		o.compressionPolicy = policy
+	}
+}
+
+// WithCompressionLevel sets the compression level, which is interpreted by the codec. For gzip, it ranges from 1 to
+// 9 and defaults to 9. For zstd, it ranges from 1 to 22 like for the zstd command line tool, with the encoder
+// picking the closest level it supports, and defaults to the best compression the encoder supports.
+func WithCompressionLevel(level int) CopyOpt {
+	return func(o *copyOptions) {
+		o.compressionLevel = level
+	}
+}
+
+// WithZstdDictionary sets a dictionary in the zstd format (e.g. created by "zstd --train") to be used for all zstd
+// compressed files, which improves compression of many small similar files. The dictionary is embedded as well.
+// Requires WithCodec(CodecZstd).
+func WithZstdDictionary(dict []byte) CopyOpt {
+	return func(o *copyOptions) {
+		o.zstdDict = dict
+	}
+}
+
+func CopyForEmbed(out string, dir string, opts ...CopyOpt) error {
+	var o copyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	fl, err := buildFileListFromDir(dir)
 	if err != nil {
 		return err
 	}
 
+	if len(o.zipImports) != 0 || o.compilePythonExe != "" {
+		tmpDir, err := os.MkdirTemp("", "embed-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+
+		if o.compilePythonExe != "" {
+			err = applyCompileBytecode(dir, tmpDir, fl, o.compilePythonExe)
+			if err != nil {
+				return err
+			}
+		}
+		for _, zi := range o.zipImports {
+			err = applyZipImport(dir, tmpDir, fl, zi)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	enc, err := newFileEncoder(&o)
+	if err != nil {
+		return err
+	}
+	defer enc.close()
+
 	log.Infof("copying to %s with %d files", out, len(fl.Files))
-	err = copyFiles(out, dir, fl)
+	err = copyFiles(out, dir, fl, enc)
 	if err != nil {
 		return err
 	}
 
+	if o.zstdDict != nil {
+		err = os.WriteFile(filepath.Join(out, zstdDictName), o.zstdDict, 0o644)
+		if err != nil {
+			return err
+		}
+		fl.ZstdDict = zstdDictName
+	}
+
 	return doWriteFilesList(dir, out, fl)
 }
 
@@ -39,7 +149,10 @@ func BuildAndWriteFilesList(dir string) error {
 }
 
 func doWriteFilesList(srcDir string, outDir string, fl *fileList) error {
-	var err error
+	err := fl.fillHashes(srcDir)
+	if err != nil {
+		return err
+	}
 	fl.ContentHash, err = calcContentHash(srcDir, fl)
 	if err != nil {
 		return err
@@ -87,13 +200,44 @@ var Data, _ = fs.Sub(_data, "%s-%s")
 	return os.WriteFile(filepath.Join(targetDir, fname), []byte(embedSrc), 0o644)
 }
 
-func copyFiles(out string, dir string, fl *fileList) error {
+// WriteFallbackEmbedGoFile writes a Go file that declares a nil Data for all platforms not contained in the given
+// list of platforms (in the form "<os>-<arch>"). This allows depending packages to still compile on platforms for
+// which no embedded files were generated via WriteEmbedGoFile.
+func WriteFallbackEmbedGoFile(targetDir string, platforms []string) error {
+	var constraints []string
+	for _, p := range platforms {
+		s := strings.SplitN(p, "-", 2)
+		if len(s) != 2 {
+			return fmt.Errorf("invalid platform %s", p)
+		}
+		constraints = append(constraints, fmt.Sprintf("!(%s && %s)", s[0], s[1]))
+	}
+	sort.Strings(constraints)
+
+	embedSrc := fmt.Sprintf(`//go:build %s
+
+package data
+
+import "io/fs"
+
+// Data is nil on platforms for which no embedded files were generated.
+var Data fs.FS
+`, strings.Join(constraints, " && "))
+
+	return os.WriteFile(filepath.Join(targetDir, "embed_fallback.go"), []byte(embedSrc), 0o644)
+}
+
+// maxParallelFiles limits the number of files that are copied or extracted in parallel
+const maxParallelFiles = 8
+
+// copyFiles copies all files to out, compressing them according to enc. The codec of every file is recorded in fl.
+func copyFiles(out string, dir string, fl *fileList, enc *fileEncoder) error {
 	var g errgroup.Group
-	g.SetLimit(8)
+	g.SetLimit(maxParallelFiles)
 
-	for _, fle := range fl.Files {
-		fle := fle
-		path := filepath.Join(dir, fle.Name)
+	for i := range fl.Files {
+		fle := &fl.Files[i]
+		path := fle.sourcePath(dir)
 
 		st, err := os.Lstat(path)
 		if err != nil {
@@ -116,27 +260,23 @@ func copyFiles(out string, dir string, fl *fileList) error {
 				return err
 			}
 
-			if fle.Compressed {
-				b := bytes.NewBuffer(make([]byte, 0, len(data)))
-				gz, err := gzip.NewWriterLevel(b, gzip.BestCompression)
-				if err != nil {
-					return err
-				}
-				_, err = gz.Write(data)
+			fle.Codec = CodecNone
+			if enc.shouldCompress(path) {
+				compressed, err := enc.encode(data)
 				if err != nil {
-					_ = gz.Close()
-					return err
+					return fmt.Errorf("failed to compress %s: %w", path, err)
 				}
-				err = gz.Flush()
-				_ = gz.Close()
-				if err != nil {
-					return err
+				if len(compressed) < len(data) {
+					fle.Codec = enc.codec
+					data = compressed
 				}
-				data = b.Bytes()
-				outPath += ".gz"
 			}
 
-			err = os.WriteFile(outPath, data, 0o644)
+			ext, err := fle.Codec.extension()
+			if err != nil {
+				return err
+			}
+			err = os.WriteFile(outPath+ext, data, 0o644)
 			if err != nil {
 				return err
 			}
@@ -154,7 +294,7 @@ func copyFiles(out string, dir string, fl *fileList) error {
 func calcContentHash(dir string, fl *fileList) (string, error) {
 	hash := sha256.New()
 	for _, fle := range fl.Files {
-		path := filepath.Join(dir, fle.Name)
+		path := fle.sourcePath(dir)
 		st, err := os.Lstat(path)
 		if err != nil {
 			return "", err
@@ -174,8 +314,7 @@ func calcContentHash(dir string, fl *fileList) (string, error) {
 			_ = binary.Write(hash, binary.LittleEndian, "dir")
 			_ = binary.Write(hash, binary.LittleEndian, fle.Name)
 		} else if st.Mode().IsRegular() {
-			outPath := filepath.Join(dir, fle.Name)
-			data, err := os.ReadFile(outPath)
+			data, err := os.ReadFile(path)
 			if err != nil {
 				return "", err
 			}
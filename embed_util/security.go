@@ -0,0 +1,121 @@
+package embed_util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SecurityError is returned when an extraction directory or one of its parents can't be trusted, e.g. because it is
+// owned or writable by another user or is a symlink. These checks are only done for extraction directories inside
+// the user's cache directory or a shared temporary directory, which includes the default location used by
+// NewEmbeddedFiles.
+type SecurityError struct {
+	Path   string
+	Reason string
+}
+
+func (e *SecurityError) Error() string {
+	return fmt.Sprintf("refusing to use %s: %s", e.Path, e.Reason)
+}
+
+// defaultTmpDir returns the base path of the extraction directory used by NewEmbeddedFiles and GC. Files are
+// extracted into the user's cache directory, as other users can't interfere with it. The shared temporary
+// directory is only used if there is no cache directory, e.g. because $HOME is not set.
+func defaultTmpDir(name string) string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return legacyTmpDir(name)
+	}
+	return filepath.Join(cacheDir, "go-embedded", name)
+}
+
+// legacyTmpDir returns the base path of the extraction directory used by NewEmbeddedFiles before it moved into the
+// user's cache directory
+func legacyTmpDir(name string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("go-embedded-%s", name))
+}
+
+// trustRoot returns the user's cache directory or the shared temporary directory that contains tmpDir, or an empty
+// string if tmpDir is somewhere else. The most specific directory wins, as the cache directory might itself be inside
+// a temporary directory.
+func trustRoot(tmpDir string) string {
+	abs, err := filepath.Abs(tmpDir)
+	if err != nil {
+		return ""
+	}
+	roots := append([]string{os.TempDir()}, sharedTmpDirs...)
+	cacheDir, err := os.UserCacheDir()
+	if err == nil {
+		roots = append(roots, cacheDir)
+	}
+
+	var best string
+	for _, root := range roots {
+		root, err = filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(root) > len(best) {
+			best = root
+		}
+	}
+	return best
+}
+
+// prepareExtractionPath creates the parent directories of the given extraction directory and verifies that these,
+// the extraction directory and its lock files can be trusted. Each directory between root and the extraction
+// directory is verified before anything is created inside of it, so that nothing is created through a planted
+// symlink. The root itself may be a symlink, e.g. /tmp on macOS, but none of the directories below it. Entries that
+// don't exist yet are fine, as long as the parent ensures that nobody else can replace them after they were created
+// by us. If root is empty, the parent directories are created without verifying anything, see trustRoot.
+func prepareExtractionPath(root string, path string) error {
+	if root == "" {
+		return os.MkdirAll(filepath.Dir(path), 0o755)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(root, 0o755)
+	if err != nil {
+		return err
+	}
+	err = checkRootDir(root)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	dir := root
+	if rel != "." {
+		for _, c := range strings.Split(rel, string(filepath.Separator)) {
+			dir = filepath.Join(dir, c)
+			// Mkdir does not follow a symlink found at dir, which is then refused by checkParentDir
+			err = os.Mkdir(dir, 0o755)
+			if err != nil && !os.IsExist(err) {
+				return err
+			}
+			err = checkParentDir(dir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, p := range []string{path, path + ".lock", usageLockPath(path), completeMarkerPath(path)} {
+		err = checkOwnedPath(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
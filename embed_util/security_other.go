@@ -0,0 +1,26 @@
+//go:build !unix
+
+package embed_util
+
+// openNoFollow is not needed on Windows, as creating symlinks requires special privileges, and is not available on
+// the other platforms that are not Unix
+const openNoFollow = 0
+
+// sharedTmpDirs is empty on Windows, where the temporary directory is per user
+var sharedTmpDirs []string
+
+// checkRootDir is a no-op on Windows, where the temporary directory is per user, and on other platforms that are not
+// Unix
+func checkRootDir(path string) error {
+	return nil
+}
+
+// checkParentDir is a no-op, see checkRootDir
+func checkParentDir(path string) error {
+	return nil
+}
+
+// checkOwnedPath is a no-op, see checkRootDir
+func checkOwnedPath(path string) error {
+	return nil
+}
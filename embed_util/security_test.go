@@ -0,0 +1,69 @@
+package embed_util
+
+import (
+	"fmt"
+	"github.com/kluctl/go-embed-python/internal"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSecurity(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ownership is not checked on windows")
+	}
+
+	fs1 := fstest.MapFS{"mymod.py": &fstest.MapFile{Data: []byte("x = 1\n"), Mode: 0o644}}
+
+	// writable by everyone, but not sticky
+	shared := t.TempDir()
+	assert.NoError(t, os.Chmod(shared, 0o777))
+	_, err := NewEmbeddedFilesWithTmpDir(fs1, filepath.Join(shared, "x"), false)
+	var secErr *SecurityError
+	assert.ErrorAs(t, err, &secErr)
+
+	// planted symlink
+	dir := t.TempDir()
+	target := t.TempDir()
+	assert.NoError(t, os.Symlink(target, filepath.Join(dir, "x")))
+	_, err = NewEmbeddedFilesWithTmpDir(fs1, filepath.Join(dir, "x"), false)
+	assert.ErrorAs(t, err, &secErr)
+	assert.False(t, internal.Exists(filepath.Join(target, "mymod.py")))
+
+	// symlink further up
+	assert.NoError(t, os.Symlink(target, filepath.Join(dir, "a")))
+	_, err = NewEmbeddedFilesWithTmpDir(fs1, filepath.Join(dir, "a", "b", "x"), false)
+	assert.ErrorAs(t, err, &secErr)
+	// nothing was created through the symlink
+	des, err := os.ReadDir(target)
+	assert.NoError(t, err)
+	assert.Empty(t, des)
+
+	// sticky like /tmp
+	assert.NoError(t, os.Chmod(shared, 0o777|os.ModeSticky))
+	e, err := NewEmbeddedFilesWithTmpDir(fs1, filepath.Join(shared, "x"), false)
+	assert.NoError(t, err)
+	assert.NoError(t, e.Cleanup())
+}
+
+func TestTrustRoot(t *testing.T) {
+	useTempCacheDir(t)
+	tmpDir, err := filepath.Abs(os.TempDir())
+	assert.NoError(t, err)
+	cacheDir, err := os.UserCacheDir()
+	assert.NoError(t, err)
+
+	assert.Equal(t, tmpDir, trustRoot(filepath.Join(os.TempDir(), "a", "x")))
+	// the cache dir is inside the temporary directory here
+	assert.Equal(t, cacheDir, trustRoot(defaultTmpDir("x")))
+	assert.Equal(t, "", trustRoot(os.TempDir()))
+
+	// locations chosen by the caller are not verified
+	private, err := filepath.Abs(filepath.Join(string(filepath.Separator), fmt.Sprintf("test-private-%d", rand.Uint32()), "x"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", trustRoot(private))
+}
@@ -0,0 +1,82 @@
+//go:build unix
+
+package embed_util
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// sharedTmpDirs are the common temporary directories besides os.TempDir that are shared by all users
+var sharedTmpDirs = []string{"/tmp", "/var/tmp", "/dev/shm"}
+
+// openNoFollow is passed when opening lock files, so that a symlink planted in a shared directory is not followed
+const openNoFollow = syscall.O_NOFOLLOW
+
+// isTrustedOwner returns true if the given file is owned by the current user or by root
+func isTrustedOwner(st fs.FileInfo) bool {
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return int(sys.Uid) == os.Geteuid() || sys.Uid == 0
+}
+
+// checkRootDir verifies the cache or temporary directory below which extraction happens. Other than the directories
+// below it, the root may be a symlink.
+func checkRootDir(path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return checkDir(path, st)
+}
+
+// checkParentDir verifies a directory between the root and the extraction directory
+func checkParentDir(path string) error {
+	st, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if st.Mode().Type() == fs.ModeSymlink {
+		return &SecurityError{Path: path, Reason: "parent directory is a symlink"}
+	}
+	return checkDir(path, st)
+}
+
+// checkDir verifies a directory that contains the extraction directory. Directories writable by others, e.g. /tmp,
+// are only accepted with the sticky bit set, as others could otherwise replace our files.
+func checkDir(path string, st fs.FileInfo) error {
+	if !st.IsDir() {
+		return &SecurityError{Path: path, Reason: "parent is not a directory"}
+	}
+	if !isTrustedOwner(st) {
+		return &SecurityError{Path: path, Reason: "parent directory is owned by another user"}
+	}
+	if st.Mode().Perm()&0o022 != 0 && st.Mode()&fs.ModeSticky == 0 {
+		return &SecurityError{Path: path, Reason: "parent directory is writable by others and not sticky"}
+	}
+	return nil
+}
+
+// checkOwnedPath verifies an extraction directory or lock file, if it exists
+func checkOwnedPath(path string) error {
+	st, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if st.Mode().Type() == fs.ModeSymlink {
+		return &SecurityError{Path: path, Reason: "is a symlink"}
+	}
+	if !isTrustedOwner(st) {
+		return &SecurityError{Path: path, Reason: "is owned by another user"}
+	}
+	if st.Mode().Perm()&0o022 != 0 {
+		return &SecurityError{Path: path, Reason: "is writable by group or others"}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package embed_util
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gofrs/flock"
+)
+
+// Every extraction directory has two lock files next to it. <dir>.lock is locked exclusively while files are being
+// extracted. <dir>.usage.lock is locked shared by everyone using the extracted files, so that these are only removed
+// by Cleanup and GC when they can acquire an exclusive lock on both.
+
+// Usage represents the usage of an extraction directory, see RegisterUsage.
+type Usage struct {
+	lock *flock.Flock
+}
+
+// RegisterUsage registers the usage of an extraction directory (see EmbeddedFiles.GetExtractedPath) by the current
+// process, which prevents Cleanup and GC in other processes from removing it until Release is called. This is
+// useful for child processes that use the extracted files and might outlive the process that extracted them.
+func RegisterUsage(extractedPath string) (*Usage, error) {
+	lock, err := lockFile(usageLockPath(extractedPath), false)
+	if err != nil {
+		return nil, err
+	}
+	// the directory can't be removed anymore while we hold the lock
+	st, err := os.Stat(extractedPath)
+	if err == nil && !st.IsDir() {
+		err = fmt.Errorf("%s is not a directory", extractedPath)
+	}
+	if err != nil {
+		_ = lock.Close()
+		if os.IsNotExist(err) {
+			// don't leave the lock file behind
+			_ = removeUnusedDir(extractedPath)
+		}
+		return nil, err
+	}
+	return &Usage{lock: lock}, nil
+}
+
+// Release releases the usage. The extracted files are not removed, even if they are not used by anyone else
+// anymore.
+func (u *Usage) Release() error {
+	return u.lock.Close()
+}
+
+// usageLockPath returns the path of the lock file that is locked by all users of an extraction directory
+func usageLockPath(path string) string {
+	return path + ".usage.lock"
+}
+
+// removeUnusedDir removes the given extraction directory and its lock files, unless it is currently being extracted
+// or used by another process
+func removeUnusedDir(path string) error {
+	lock := flock.New(path + ".lock")
+	locked, err := lock.TryLock()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	defer lock.Close()
+
+	usageLock := flock.New(usageLockPath(path))
+	locked, err = usageLock.TryLock()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	defer usageLock.Close()
+
+	// the marker is removed first, so that an interrupted removal is not mistaken for a complete extraction
+	err = os.Remove(completeMarkerPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = removeStagingDirs(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+	// processes that are waiting for the locks notice that the lock files are gone, see lockFile. Removing them
+	// might fail on Windows if they are still opened by another process, in which case they are simply kept.
+	_ = os.Remove(usageLockPath(path))
+	_ = os.Remove(path + ".lock")
+	return nil
+}
+
+// lockFile acquires a lock on the given lock file. As lock files are removed while holding an exclusive lock, the
+// lock might end up being acquired on a file that was already removed, in which case locking is retried.
+func lockFile(path string, exclusive bool) (*flock.Flock, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY|openNoFollow, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		st1, err := f.Stat()
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		lock := flock.New(path)
+		if exclusive {
+			err = lock.Lock()
+		} else {
+			err = lock.RLock()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// the file found at path can't become st1 again once it was replaced, so the locked file must be st1. Lstat
+		// makes sure that a symlink that replaced it is not accepted either.
+		st2, err := os.Lstat(path)
+		if err == nil && os.SameFile(st1, st2) {
+			return lock, nil
+		}
+		_ = lock.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,62 @@
+//go:build unix && !solaris && !aix
+
+package embed_util
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// RegisterChildUsage registers the usage of an extraction directory by a child process. The returned file holds a
+// shared lock on the usage lock file and must be passed to the child, e.g. via exec.Cmd.ExtraFiles, and closed in the
+// current process after the child was started. The lock is then held until the child and all processes that
+// inherited the file from it have exited, so that Cleanup and GC don't remove the extracted files while they are in
+// use. On Windows, nil is returned, as files that are in use can't be removed there anyway. On Solaris, AIX and other
+// platforms without flock, nil is returned as well.
+func RegisterChildUsage(extractedPath string) (*os.File, error) {
+	f, err := lockInheritableFile(usageLockPath(extractedPath))
+	if err != nil {
+		return nil, err
+	}
+	st, err := os.Stat(extractedPath)
+	if err == nil && !st.IsDir() {
+		err = fmt.Errorf("%s is not a directory", extractedPath)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// lockInheritableFile is like lockFile with a shared lock, but returns the locked file itself. Unlike fcntl locks,
+// flock locks belong to the open file description, so the lock is shared with child processes inheriting the file.
+func lockInheritableFile(path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY|openNoFollow, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+
+		// see lockFile
+		st1, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		st2, err := os.Lstat(path)
+		if err == nil && os.SameFile(st1, st2) {
+			return f, nil
+		}
+		_ = f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
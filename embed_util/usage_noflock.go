@@ -0,0 +1,12 @@
+//go:build !unix || solaris || aix
+
+package embed_util
+
+import "os"
+
+// RegisterChildUsage returns nil on platforms without flock, see the flock based implementation. Files that are in use
+// can't be removed on Windows anyway, while the fcntl locks that Solaris and AIX provide instead are not shared with
+// child processes.
+func RegisterChildUsage(extractedPath string) (*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,59 @@
+package embed_util
+
+import (
+	"fmt"
+	"github.com/kluctl/go-embed-python/internal"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCleanupInUse(t *testing.T) {
+	useTempCacheDir(t)
+	name := fmt.Sprintf("test-cleanup-%d", rand.Uint32())
+	fsys := fstest.MapFS{"mymod.py": &fstest.MapFile{Data: []byte("x = 1\n"), Mode: 0o644}}
+
+	e1, err := NewEmbeddedFiles(fsys, name)
+	assert.NoError(t, err)
+	e2, err := NewEmbeddedFiles(fsys, name)
+	assert.NoError(t, err)
+	path := e1.GetExtractedPath()
+	assert.Equal(t, path, e2.GetExtractedPath())
+
+	assert.NoError(t, e1.Cleanup())
+	assert.True(t, internal.Exists(filepath.Join(path, "mymod.py")))
+
+	assert.NoError(t, e2.Cleanup())
+	assert.False(t, internal.Exists(path))
+	assert.False(t, internal.Exists(path+".lock"))
+	assert.False(t, internal.Exists(path+".usage.lock"))
+
+	_, err = RegisterUsage(path)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.False(t, internal.Exists(path+".usage.lock"))
+}
+
+func TestRelease(t *testing.T) {
+	useTempCacheDir(t)
+	name := fmt.Sprintf("test-release-%d", rand.Uint32())
+	fsys := fstest.MapFS{"mymod.py": &fstest.MapFile{Data: []byte("x = 1\n"), Mode: 0o644}}
+
+	e, err := NewEmbeddedFiles(fsys, name)
+	assert.NoError(t, err)
+	path := e.GetExtractedPath()
+	assert.NoError(t, e.Release())
+	assert.True(t, internal.Exists(filepath.Join(path, "mymod.py")))
+
+	// reused without extracting again
+	e, err = NewEmbeddedFiles(fsys, name)
+	assert.NoError(t, err)
+	assert.Equal(t, path, e.GetExtractedPath())
+	assert.NoError(t, e.Release())
+
+	// not in use anymore, so GC can remove it
+	assert.NoError(t, GC(name))
+	assert.False(t, internal.Exists(path))
+}
@@ -0,0 +1,173 @@
+package embed_util
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type zipImport struct {
+	root    string
+	zipName string
+}
+
+// zipModTime is used for all zip entries so that packing is reproducible
+var zipModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// applyZipImport moves all pure-Python top-level modules and packages found inside zi.root into a zip file, which is
+// written to tmpDir. The moved entries are removed from the file list and replaced by a single entry for the zip
+// file. Packages that contain anything other than .py files (e.g. native extensions or data files) are kept as they
+// are, as these must exist as real files at runtime.
+func applyZipImport(dir string, tmpDir string, fl *fileList, zi zipImport) error {
+	root := filepath.Clean(zi.root)
+	zipName := filepath.Clean(zi.zipName)
+
+	m := fl.toMap()
+	if root != "." {
+		if fle, ok := m[root]; !ok || !fle.Mode.IsDir() {
+			return fmt.Errorf("zip import root %s is not a directory", zi.root)
+		}
+	}
+	if d := filepath.Dir(zipName); d != "." {
+		if fle, ok := m[d]; !ok || !fle.Mode.IsDir() {
+			return fmt.Errorf("parent directory of %s does not exist", zi.zipName)
+		}
+	}
+	if _, ok := m[zipName]; ok {
+		return fmt.Errorf("%s already exists", zi.zipName)
+	}
+
+	// group all entries below root by their top-level entry
+	trees := map[string][]fileListEntry{}
+	for _, fle := range fl.Files {
+		rel, err := filepath.Rel(root, fle.Name)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		top := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+		trees[top] = append(trees[top], fle)
+	}
+
+	zipped := map[string]bool{}
+	var zipEntries []fileListEntry
+	for _, entries := range trees {
+		if !isPurePythonTree(entries) {
+			continue
+		}
+		for _, fle := range entries {
+			zipped[fle.Name] = true
+			zipEntries = append(zipEntries, fle)
+		}
+	}
+	if len(zipEntries) == 0 {
+		return nil
+	}
+	sort.Slice(zipEntries, func(i, j int) bool {
+		return zipEntries[i].Name < zipEntries[j].Name
+	})
+
+	zipPath := filepath.Join(tmpDir, fmt.Sprintf("%d.zip", len(fl.ZipImports)))
+	err := writeZip(zipPath, dir, root, zipEntries)
+	if err != nil {
+		return err
+	}
+	st, err := os.Stat(zipPath)
+	if err != nil {
+		return err
+	}
+
+	files := make([]fileListEntry, 0, len(fl.Files))
+	for _, fle := range fl.Files {
+		if !zipped[fle.Name] {
+			files = append(files, fle)
+		}
+	}
+	files = append(files, fileListEntry{
+		Name:    zipName,
+		Size:    st.Size(),
+		Mode:    0o644,
+		srcPath: zipPath,
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	fl.Files = files
+	fl.ZipImports = append(fl.ZipImports, zipName)
+	return nil
+}
+
+func isPurePythonTree(entries []fileListEntry) bool {
+	for _, fle := range entries {
+		if fle.Mode.IsDir() || isBytecodeEntry(fle) {
+			continue
+		}
+		if !fle.Mode.IsRegular() || filepath.Ext(fle.Name) != ".py" {
+			return false
+		}
+	}
+	return true
+}
+
+func writeZip(zipPath string, dir string, root string, entries []fileListEntry) error {
+	f, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	z := zip.NewWriter(f)
+	for _, fle := range entries {
+		name := fle.Name
+		if isBytecodeEntry(fle) {
+			if fle.Mode.IsDir() {
+				continue
+			}
+			// zipimport does not know about __pycache__
+			name = legacyBytecodeName(name)
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+
+		h := &zip.FileHeader{
+			Name:     filepath.ToSlash(rel),
+			Method:   zip.Deflate,
+			Modified: zipModTime,
+		}
+		if fle.Mode.IsDir() {
+			// directory entries are required for zipimport to find namespace packages
+			h.Name += "/"
+			h.Method = zip.Store
+		}
+		h.SetMode(fle.Mode)
+
+		w, err := z.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		if fle.Mode.IsDir() {
+			continue
+		}
+
+		src, err := os.Open(fle.sourcePath(dir))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, src)
+		_ = src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	err = z.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"os"
+	"runtime"
+)
+
+// CacheDirEnv returns the environment variable that os.UserCacheDir is based on
+func CacheDirEnv() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "LocalAppData"
+	case "darwin", "ios":
+		return "HOME"
+	case "plan9":
+		return "home"
+	default:
+		return "XDG_CACHE_HOME"
+	}
+}
+
+// SetTempCacheDir points os.UserCacheDir to a new temporary directory, so that tests don't extract into the real
+// cache directory. The returned function restores the environment and removes the temporary directory.
+func SetTempCacheDir() (func(), error) {
+	dir, err := os.MkdirTemp("", "go-embedded-cache-")
+	if err != nil {
+		return nil, err
+	}
+	env := CacheDirEnv()
+	old, hadOld := os.LookupEnv(env)
+	err = os.Setenv(env, dir)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	return func() {
+		if hadOld {
+			_ = os.Setenv(env, old)
+		} else {
+			_ = os.Unsetenv(env)
+		}
+		_ = os.RemoveAll(dir)
+	}, nil
+}
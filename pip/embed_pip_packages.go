@@ -20,6 +20,7 @@ func CreateEmbeddedPipPackagesForKnownPlatforms(requirementsFile string, targetD
 		"windows-amd64": {"win_amd64"},
 	}
 
+	var goPlatforms []string
 	for goPlatform, pipPlatforms := range platforms {
 		s := strings.Split(goPlatform, "-")
 		goOs, goArch := s[0], s[1]
@@ -27,8 +28,9 @@ func CreateEmbeddedPipPackagesForKnownPlatforms(requirementsFile string, targetD
 		if err != nil {
 			return err
 		}
+		goPlatforms = append(goPlatforms, goPlatform)
 	}
-	return nil
+	return embed_util.WriteFallbackEmbedGoFile(targetDir, goPlatforms)
 }
 
 func CreateEmbeddedPipPackages(requirementsFile string, goOs string, goArch string, pipPlatforms []string, targetDir string) error {
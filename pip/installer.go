@@ -0,0 +1,147 @@
+package pip
+
+import (
+	"context"
+	"fmt"
+	"github.com/kluctl/go-embed-python/python"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Installer installs packages at runtime into Target, using the embedded pip. After the first successful
+// installation, Target is added to the Python path of Python. An Installer must not be copied after first use.
+type Installer struct {
+	Python python.Python
+	Target string
+
+	// mutex protects added, which contains the targets that were already added to the Python path
+	mutex sync.Mutex
+	added map[installedTarget]bool
+}
+
+type installedTarget struct {
+	python python.Python
+	target string
+}
+
+type installOptions struct {
+	findLinks []string
+	noIndex   bool
+	upgrade   bool
+	noDeps    bool
+}
+
+type InstallOpt func(o *installOptions)
+
+// WithFindLinks adds a local directory (or URL) to look for archives/wheels in. See `pip install --find-links`.
+func WithFindLinks(dir string) InstallOpt {
+	return func(o *installOptions) {
+		o.findLinks = append(o.findLinks, dir)
+	}
+}
+
+// WithNoIndex prevents pip from contacting any package index. See `pip install --no-index`.
+func WithNoIndex() InstallOpt {
+	return func(o *installOptions) {
+		o.noIndex = true
+	}
+}
+
+// WithUpgrade causes already installed packages in Target to be replaced. See `pip install --upgrade`.
+func WithUpgrade() InstallOpt {
+	return func(o *installOptions) {
+		o.upgrade = true
+	}
+}
+
+// WithNoDeps prevents pip from installing dependencies. See `pip install --no-deps`.
+func WithNoDeps() InstallOpt {
+	return func(o *installOptions) {
+		o.noDeps = true
+	}
+}
+
+// Install runs `pip install --target` for the given requirements. reqs are passed to pip as is, so anything accepted
+// by pip (e.g. "jinja2==3.1.2" or "-r", "requirements.txt") can be used.
+func (i *Installer) Install(ctx context.Context, reqs []string, opts ...InstallOpt) error {
+	var o installOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	target, err := filepath.Abs(i.Target)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(target, 0o755)
+	if err != nil {
+		return err
+	}
+
+	// the extracted pip is kept afterwards, so that it can be reused by the next installation
+	pipLib, err := NewPipLib("pip")
+	if err != nil {
+		return err
+	}
+	defer pipLib.Release()
+
+	args := []string{"-m", "pip", "install", "--target", target, "--disable-pip-version-check", "--no-input"}
+	for _, l := range o.findLinks {
+		args = append(args, "--find-links", l)
+	}
+	if o.noIndex {
+		args = append(args, "--no-index")
+	}
+	if o.upgrade {
+		args = append(args, "--upgrade")
+	}
+	if o.noDeps {
+		args = append(args, "--no-deps")
+	}
+	args = append(args, reqs...)
+
+	cmd, err := i.Python.PythonCmdContext(ctx, args...)
+	if err != nil {
+		return err
+	}
+	// pip is only made available to this invocation, not to the Python instance itself
+	cmd.Env = prependPythonPath(cmd.Env, pipLib.GetExtractedPath())
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pip install failed: %w\n%s", err, string(out))
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	key := installedTarget{python: i.Python, target: target}
+	if !i.added[key] {
+		if i.added == nil {
+			i.added = map[installedTarget]bool{}
+		}
+		i.Python.AddPythonPath(target)
+		i.added[key] = true
+	}
+	return nil
+}
+
+func prependPythonPath(env []string, p string) []string {
+	ret := make([]string, 0, len(env)+1)
+	found := false
+	for _, e := range env {
+		if v, ok := strings.CutPrefix(e, "PYTHONPATH="); ok {
+			if v != "" {
+				p = p + string(os.PathListSeparator) + v
+			}
+			e = "PYTHONPATH=" + p
+			found = true
+		}
+		ret = append(ret, e)
+	}
+	if !found {
+		ret = append(ret, "PYTHONPATH="+p)
+	}
+	return ret
+}
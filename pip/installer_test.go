@@ -0,0 +1,78 @@
+package pip
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"github.com/kluctl/go-embed-python/internal"
+	"github.com/kluctl/go-embed-python/python"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain isolates all tests from the real cache directory, into which embedded files are extracted by default
+func TestMain(m *testing.M) {
+	restore, err := internal.SetTempCacheDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	restore()
+	os.Exit(code)
+}
+
+func writeTestWheel(t *testing.T, dir string) {
+	f, err := os.Create(filepath.Join(dir, "hello-1.0-py3-none-any.whl"))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	files := map[string]string{
+		"hello.py":                     "def greet():\n    return 'hello'\n",
+		"hello-1.0.dist-info/METADATA": "Metadata-Version: 2.1\nName: hello\nVersion: 1.0\n",
+		"hello-1.0.dist-info/WHEEL":    "Wheel-Version: 1.0\nGenerator: test\nRoot-Is-Purelib: true\nTag: py3-none-any\n",
+		"hello-1.0.dist-info/RECORD":   "hello.py,,\nhello-1.0.dist-info/METADATA,,\nhello-1.0.dist-info/WHEEL,,\nhello-1.0.dist-info/RECORD,,\n",
+	}
+	z := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := z.Create(name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, z.Close())
+}
+
+func TestInstaller(t *testing.T) {
+	ep, err := python.NewEmbeddedPython(fmt.Sprintf("test-%d", rand.Uint32()))
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	wheelhouse := t.TempDir()
+	writeTestWheel(t, wheelhouse)
+
+	i := Installer{
+		Python: ep,
+		Target: filepath.Join(t.TempDir(), "packages"),
+	}
+	err = i.Install(context.Background(), []string{"hello"}, WithFindLinks(wheelhouse), WithNoIndex())
+	assert.NoError(t, err)
+
+	res, err := ep.Run(context.Background(), python.RunSpec{
+		Code: "import hello; print(hello.greet())",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(res.Stdout))
+
+	// installing again does not add the target again
+	err = i.Install(context.Background(), []string{"hello"}, WithFindLinks(wheelhouse), WithNoIndex(), WithUpgrade())
+	assert.NoError(t, err)
+	res, err = ep.Run(context.Background(), python.RunSpec{
+		Code: fmt.Sprintf("import sys; print(sys.path.count(%q))", i.Target),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n", string(res.Stdout))
+}
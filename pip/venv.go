@@ -0,0 +1,19 @@
+package pip
+
+import (
+	"github.com/kluctl/go-embed-python/python"
+)
+
+// CreateVenv creates a venv via EmbeddedPython.CreateVenv and seeds it with the embedded pip, so that
+// `python -m pip` can be used inside the venv.
+func CreateVenv(ep *python.EmbeddedPython, path string, opts python.VenvOptions) (*python.Venv, error) {
+	// the extracted pip is only needed while seeding and is kept afterwards, so that it can be reused next time
+	pipLib, err := NewPipLib("pip")
+	if err != nil {
+		return nil, err
+	}
+	defer pipLib.Release()
+
+	opts.SeedPaths = append(opts.SeedPaths, pipLib.GetExtractedPath())
+	return ep.CreateVenv(path, opts)
+}
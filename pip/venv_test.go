@@ -0,0 +1,34 @@
+package pip
+
+import (
+	"context"
+	"fmt"
+	"github.com/kluctl/go-embed-python/python"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateVenv(t *testing.T) {
+	ep, err := python.NewEmbeddedPython(fmt.Sprintf("test-%d", rand.Uint32()))
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	for i := 0; i < 2; i++ {
+		venv, err := CreateVenv(ep, filepath.Join(t.TempDir(), "venv"), python.VenvOptions{})
+		assert.NoError(t, err)
+
+		res, err := venv.Run(context.Background(), python.RunSpec{
+			Code: "import pip; print(pip.__name__)",
+		})
+		assert.NoError(t, err, string(res.Stderr))
+		assert.Equal(t, "pip\n", string(res.Stdout))
+	}
+
+	// the extracted pip is kept for reuse
+	pipLib, err := NewPipLib("pip")
+	assert.NoError(t, err)
+	defer pipLib.Release()
+	assert.DirExists(t, pipLib.GetExtractedPath())
+}
@@ -0,0 +1,123 @@
+package python
+
+import (
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditAction tells the audit hook what to do when an audit event is raised.
+type AuditAction string
+
+const (
+	// AuditAllow allows the event without reporting it. This is the default.
+	AuditAllow AuditAction = "allow"
+	// AuditLog allows the event and reports it via AuditPolicy.OnEvent.
+	AuditLog AuditAction = "log"
+	// AuditDeny reports the event via AuditPolicy.OnEvent and raises a PermissionError in the interpreter, which
+	// aborts the audited operation.
+	AuditDeny AuditAction = "deny"
+)
+
+// auditEventGroups contains the audit events covered by the fields of AuditPolicy. See
+// https://docs.python.org/3/library/audit_events.html for all events.
+var auditEventGroups = map[string][]string{
+	"network":    {"socket.connect", "socket.sendto", "socket.sendmsg"},
+	"subprocess": {"subprocess.Popen", "os.system", "os.exec", "os.posix_spawn", "os.spawn", "os.fork", "os.forkpty"},
+	"ctypes":     {"ctypes.dlopen"},
+}
+
+// AuditPolicy configures an audit hook (see sys.addaudithook) that is installed before any user code runs. It allows
+// to deny or log potentially dangerous operations performed by the Python code.
+//
+// Please note that audit hooks are not a security boundary on their own, as Python code can circumvent them, e.g. via
+// ctypes. Deny Ctypes and combine the policy with a Sandbox when running untrusted code.
+type AuditPolicy struct {
+	// Network applies to outgoing network connections and datagrams.
+	Network AuditAction
+	// Subprocess applies to all ways of spawning new processes, including os.fork.
+	Subprocess AuditAction
+	// FileWrite applies to files opened for writing outside of AllowedWriteDirs.
+	FileWrite AuditAction
+	// AllowedWriteDirs contains directories in which files may be opened for writing, regardless of FileWrite.
+	AllowedWriteDirs []string
+	// Ctypes applies to loading of shared libraries via ctypes. Denying it also denies importing ctypes.
+	Ctypes AuditAction
+
+	// Events contains actions for arbitrary audit events, keyed by event name. These take precedence over the
+	// actions configured above.
+	Events map[string]AuditAction
+
+	// OnEvent is called for each event that was logged or denied. It is called from a separate goroutine, but never
+	// concurrently for the same process. If nil, events are logged via logrus.
+	OnEvent func(e AuditEvent)
+}
+
+// AuditEvent describes an audit event that was logged or denied by an AuditPolicy.
+type AuditEvent struct {
+	// Event is the name of the audit event, e.g. "socket.connect".
+	Event string `json:"event"`
+	// Args contains the arguments of the audit event. Values that can't be represented in JSON are converted via
+	// repr().
+	Args   []any `json:"args"`
+	Denied bool  `json:"denied"`
+	// Pid is the pid of the process that raised the event, as seen from inside the interpreter.
+	Pid int `json:"pid"`
+}
+
+// WithAuditPolicy installs an audit hook with the given policy into all interpreters started by the Python instance.
+// Events are only reported back for interpreters started via Command, Run or a Worker, see Cmd. They are passed through
+// an inherited pipe, which is not supported on Windows. The policy is still enforced in all cases, but OnEvent is not
+// called.
+func WithAuditPolicy(policy AuditPolicy) PythonOpt {
+	return func(o *python) {
+		o.auditPolicy = &policy
+	}
+}
+
+// auditConfig is the audit part of launcherConfig
+type auditConfig struct {
+	Events           map[string]AuditAction `json:"events"`
+	FileWrite        AuditAction            `json:"fileWrite,omitempty"`
+	AllowedWriteDirs []string               `json:"allowedWriteDirs,omitempty"`
+}
+
+func (p *AuditPolicy) buildConfig() *auditConfig {
+	cfg := &auditConfig{
+		Events:    map[string]AuditAction{},
+		FileWrite: p.FileWrite,
+	}
+	addGroup := func(group string, action AuditAction) {
+		if action == "" || action == AuditAllow {
+			return
+		}
+		for _, e := range auditEventGroups[group] {
+			cfg.Events[e] = action
+		}
+	}
+	addGroup("network", p.Network)
+	addGroup("subprocess", p.Subprocess)
+	addGroup("ctypes", p.Ctypes)
+	for e, action := range p.Events {
+		cfg.Events[e] = action
+	}
+	for _, d := range p.AllowedWriteDirs {
+		if abs, err := filepath.Abs(d); err == nil {
+			cfg.AllowedWriteDirs = append(cfg.AllowedWriteDirs, abs)
+		}
+	}
+	return cfg
+}
+
+func (p *AuditPolicy) handleEvent(e AuditEvent) {
+	if p.OnEvent != nil {
+		p.OnEvent(e)
+		return
+	}
+	l := log.WithField("event", e.Event).WithField("args", e.Args).WithField("pid", e.Pid)
+	if e.Denied {
+		l.Warning("python audit event denied")
+	} else {
+		l.Info("python audit event")
+	}
+}
@@ -0,0 +1,90 @@
+package python
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestAuditPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("audit events are not reported on windows")
+	}
+
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	allowedDir := t.TempDir()
+	deniedDir := t.TempDir()
+
+	var mutex sync.Mutex
+	var events []AuditEvent
+	p := ep.With(WithAuditPolicy(AuditPolicy{
+		Network:          AuditDeny,
+		Subprocess:       AuditLog,
+		FileWrite:        AuditDeny,
+		AllowedWriteDirs: []string{allowedDir},
+		Events: map[string]AuditAction{
+			"os.chdir": AuditLog,
+		},
+		OnEvent: func(e AuditEvent) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, e)
+		},
+	}))
+
+	script := `
+import os, socket, subprocess, sys
+try:
+    socket.create_connection(("127.0.0.1", 1))
+except PermissionError as e:
+    print("connect", e)
+with open(os.path.join(sys.argv[1], "allowed"), "w") as f:
+    f.write("x")
+try:
+    open(os.path.join(sys.argv[2], "denied"), "w")
+except PermissionError as e:
+    print("open denied")
+with open(os.path.join(sys.argv[1], "allowed")) as f:
+    print("read", f.read())
+os.chdir(sys.argv[1])
+subprocess.run([sys.executable, "-c", "pass"], check=True)
+print("done")
+`
+	res, err := p.Run(context.Background(), RunSpec{
+		Code: script,
+		Args: []string{allowedDir, deniedDir},
+	})
+	assert.NoError(t, err, string(res.Stderr))
+	assert.Equal(t, "connect [Errno 1] denied by audit policy: socket.connect\nopen denied\nread x\ndone\n", string(res.Stdout))
+	assert.NoFileExists(t, filepath.Join(deniedDir, "denied"))
+
+	var names []string
+	for _, e := range events {
+		names = append(names, e.Event)
+		assert.Equal(t, e.Event == "socket.connect" || e.Event == "open", e.Denied)
+		assert.NotZero(t, e.Pid)
+	}
+	assert.Equal(t, []string{"socket.connect", "open", "os.chdir", "subprocess.Popen"}, names)
+	assert.Equal(t, filepath.Join(deniedDir, "denied"), events[1].Args[0])
+	assert.Equal(t, allowedDir, events[2].Args[0])
+
+	// ctypes can be used to circumvent audit hooks, so denying it must also deny the import
+	p = ep.With(WithAuditPolicy(AuditPolicy{Ctypes: AuditDeny, OnEvent: func(e AuditEvent) {}}))
+	_, err = p.Run(context.Background(), RunSpec{Code: "import ctypes"})
+	var pyErr *PythonError
+	assert.ErrorAs(t, err, &pyErr)
+	assert.Equal(t, "PermissionError", pyErr.Type)
+
+	_, err = os.Stat(ep.GetExtractedPath())
+	assert.NoError(t, err)
+}
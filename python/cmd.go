@@ -0,0 +1,173 @@
+package python
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kluctl/go-embed-python/embed_util"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// Cmd is an interpreter command created via Python.Command. The embedded exec.Cmd can be configured as usual before
+// the command is started. Start, Run, Wait, Output and CombinedOutput must be called on the Cmd instead of the
+// embedded exec.Cmd, as they take care of forwarding log records and audit events from the interpreter (see
+// WithLogHandler and WithAuditPolicy). Wait only returns after all events have been handled.
+//
+// For an EmbeddedPython, the interpreter also holds a usage lock on the extracted files until it exits, so that these
+// are not removed by Cleanup or GC in the meantime (see embed_util.RegisterChildUsage). No resources besides the
+// exec.Cmd itself are allocated until the command is started.
+type Cmd struct {
+	*exec.Cmd
+
+	// args and launcherCfg are used to build the launcher arguments in Start, which need to know the file descriptor
+	// of the event pipe. handle is nil if the launcher does not report events.
+	args        []string
+	launcherCfg launcherConfig
+	handle      func(e *launcherEvent)
+
+	// usageDirs are the extraction directories used by the interpreter. A shared usage lock on each of them is
+	// inherited by the interpreter, see embed_util.RegisterChildUsage.
+	usageDirs []string
+
+	events *eventPipe
+}
+
+// Start starts the interpreter, see exec.Cmd.Start.
+func (c *Cmd) Start() error {
+	if (c.handle == nil && len(c.usageDirs) == 0) || c.Process != nil {
+		return c.Cmd.Start()
+	}
+
+	// the interpreter has its own copies of these once started, ours must be closed so that the usage ends and the
+	// event pipe is closed when the interpreter exits
+	var inherited []*os.File
+	defer func() {
+		for _, f := range inherited {
+			_ = f.Close()
+		}
+	}()
+
+	for _, dir := range c.usageDirs {
+		f, err := embed_util.RegisterChildUsage(dir)
+		if err != nil {
+			return fmt.Errorf("failed to register usage of %s: %w", dir, err)
+		}
+		if f != nil {
+			inherited = append(inherited, f)
+		}
+	}
+
+	var r *os.File
+	if c.handle != nil {
+		var w *os.File
+		var err error
+		r, w, err = os.Pipe()
+		if err != nil {
+			return err
+		}
+		inherited = append(inherited, w)
+
+		// the write end follows stdin, stdout, stderr and all other ExtraFiles
+		cfg := c.launcherCfg
+		cfg.EventFd = 2 + len(c.ExtraFiles) + len(inherited)
+		args, err := launcherArgs(c.args, cfg)
+		if err != nil {
+			_ = r.Close()
+			return err
+		}
+		c.Args = append(c.Args[:1], args...)
+	}
+
+	extraFiles := c.ExtraFiles
+	c.ExtraFiles = append(extraFiles[:len(extraFiles):len(extraFiles)], inherited...)
+	err := c.Cmd.Start()
+	c.ExtraFiles = extraFiles
+	if err != nil {
+		if r != nil {
+			_ = r.Close()
+		}
+		return err
+	}
+	if r != nil {
+		c.events = newEventPipe(r, c.handle)
+	}
+	return nil
+}
+
+// Wait waits for the interpreter to exit and for all events sent by it to be handled, see exec.Cmd.Wait.
+func (c *Cmd) Wait() error {
+	err := c.Cmd.Wait()
+	if c.events != nil {
+		c.events.wait()
+	}
+	return err
+}
+
+// Run starts the interpreter and waits for it to finish, see exec.Cmd.Run.
+func (c *Cmd) Run() error {
+	err := c.Start()
+	if err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Output runs the interpreter and returns its standard output, see exec.Cmd.Output. Installed output handlers still
+// receive the output.
+func (c *Cmd) Output() ([]byte, error) {
+	if !isUnsetOrLineWriter(c.Stdout) {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	var stdout bytes.Buffer
+	redirectOutput(c.Cmd, StreamStdout, &stdout)
+
+	var stderr *bytes.Buffer
+	if c.Stderr == nil {
+		stderr = &bytes.Buffer{}
+		c.Stderr = stderr
+	}
+
+	err := c.Run()
+	var exitErr *exec.ExitError
+	if stderr != nil && errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the interpreter and returns its combined standard output and standard error, see
+// exec.Cmd.CombinedOutput. Installed output handlers still receive the output.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	if !isUnsetOrLineWriter(c.Stdout) {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	if !isUnsetOrLineWriter(c.Stderr) {
+		return nil, errors.New("exec: Stderr already set")
+	}
+	b := &lockedBuffer{}
+	redirectOutput(c.Cmd, StreamStdout, b)
+	redirectOutput(c.Cmd, StreamStderr, b)
+	err := c.Run()
+	return b.buf.Bytes(), err
+}
+
+func isUnsetOrLineWriter(w io.Writer) bool {
+	_, ok := w.(*lineWriter)
+	return w == nil || ok
+}
+
+// lockedBuffer serializes writes, as stdout and stderr are copied by separate goroutines when output handlers are
+// installed
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
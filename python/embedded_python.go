@@ -1,45 +1,209 @@
 package python
 
 import (
+	"errors"
 	"fmt"
 	"github.com/kluctl/go-embed-python/embed_util"
 	"github.com/kluctl/go-embed-python/python/internal/data"
+	"io/fs"
+	"maps"
+	"runtime"
+	"sync"
 )
 
+// ErrUnsupportedPlatform is returned when no embedded Python distribution is available for the current platform.
+var ErrUnsupportedPlatform = errors.New("embedded python is not available for this platform")
+
 type EmbeddedPython struct {
 	e *embed_util.EmbeddedFiles
 	Python
+
+	// derived is true for copies created via Derive, which don't own e
+	derived bool
+
+	mutex      sync.Mutex
+	fsHashes   map[string]bool
+	extraFiles []*embed_util.EmbeddedFiles
+}
+
+// WithSystemPythonFallback causes NewEmbeddedPython and NewEmbeddedPythonWithTmpDir to fall back to the Python
+// installation of the host (see NewPython) on platforms for which no embedded distribution is available, instead of
+// failing with ErrUnsupportedPlatform.
+func WithSystemPythonFallback() PythonOpt {
+	return func(o *python) {
+		o.systemFallback = true
+	}
+}
+
+// WithAutoGC causes stale extraction directories left behind by other versions of the application to be removed when
+// the embedded distribution or files added via AddPythonPathFS are extracted. See embed_util.GC for details.
+func WithAutoGC() PythonOpt {
+	return func(o *python) {
+		o.autoGC = true
+	}
+}
+
+// WithVerifyMode sets the mode used to verify files left behind by a previous extraction of the embedded distribution
+// or of files added via AddPythonPathFS, see embed_util.WithVerifyMode.
+func WithVerifyMode(mode embed_util.VerifyMode) PythonOpt {
+	return func(o *python) {
+		o.verifyMode = mode
+	}
 }
 
 // NewEmbeddedPython creates a new EmbeddedPython instance. The embedded source code and python binaries are
 // extracted on demand using the given name as the base for the temporary directory. You should ensure that the chosen
 // name does collide with other consumers of this library.
-func NewEmbeddedPython(name string) (*EmbeddedPython, error) {
-	e, err := embed_util.NewEmbeddedFiles(data.Data, fmt.Sprintf("python-%s", name))
+func NewEmbeddedPython(name string, opts ...PythonOpt) (*EmbeddedPython, error) {
+	if data.Data == nil {
+		return newFallbackPython(opts)
+	}
+	e, err := embed_util.NewEmbeddedFiles(data.Data, fmt.Sprintf("python-%s", name), embeddedFilesOpts(opts)...)
 	if err != nil {
 		return nil, err
 	}
-	return &EmbeddedPython{
-		e:      e,
-		Python: NewPython(WithPythonHome(e.GetExtractedPath())),
-	}, nil
+	return newEmbeddedPython(e, opts), nil
 }
 
-func NewEmbeddedPythonWithTmpDir(tmpDir string, withHashInDir bool) (*EmbeddedPython, error) {
-	e, err := embed_util.NewEmbeddedFilesWithTmpDir(data.Data, tmpDir, withHashInDir)
+func NewEmbeddedPythonWithTmpDir(tmpDir string, withHashInDir bool, opts ...PythonOpt) (*EmbeddedPython, error) {
+	if data.Data == nil {
+		return newFallbackPython(opts)
+	}
+	e, err := embed_util.NewEmbeddedFilesWithTmpDir(data.Data, tmpDir, withHashInDir, embeddedFilesOpts(opts)...)
 	if err != nil {
 		return nil, err
 	}
+	return newEmbeddedPython(e, opts), nil
+}
+
+// embeddedFilesOpts returns the options for extracting the embedded files, which must be known before the Python
+// instance is created
+func embeddedFilesOpts(opts []PythonOpt) []embed_util.EmbeddedFilesOpt {
+	var o python
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.embeddedFilesOpts()
+}
+
+func (ep *python) embeddedFilesOpts() []embed_util.EmbeddedFilesOpt {
+	var ret []embed_util.EmbeddedFilesOpt
+	if ep.autoGC {
+		ret = append(ret, embed_util.WithAutoGC())
+	}
+	if ep.verifyMode != embed_util.VerifySize {
+		ret = append(ret, embed_util.WithVerifyMode(ep.verifyMode))
+	}
+	return ret
+}
+
+func newEmbeddedPython(e *embed_util.EmbeddedFiles, opts []PythonOpt) *EmbeddedPython {
+	p := NewPython(append([]PythonOpt{WithPythonHome(e.GetExtractedPath())}, opts...)...)
+	for _, zp := range e.GetZipImportPaths() {
+		p.AddPythonPath(zp)
+	}
+	p.(*python).usageDirs = []string{e.GetExtractedPath()}
 	return &EmbeddedPython{
 		e:      e,
-		Python: NewPython(WithPythonHome(e.GetExtractedPath())),
+		Python: p,
+	}
+}
+
+func newFallbackPython(opts []PythonOpt) (*EmbeddedPython, error) {
+	p := NewPython(opts...)
+	if !p.(*python).systemFallback {
+		return nil, fmt.Errorf("%w: %s/%s", ErrUnsupportedPlatform, runtime.GOOS, runtime.GOARCH)
+	}
+	return &EmbeddedPython{
+		Python: p,
 	}, nil
 }
 
+// IsFallback returns true if the host's Python installation is used due to WithSystemPythonFallback.
+func (ep *EmbeddedPython) IsFallback() bool {
+	return ep.e == nil
+}
+
+// AddPythonPathFS adds the files found in fsys to the Python path. fsys is usually the embedded data generated by
+// pip.CreateEmbeddedPipPackages. The files are extracted on demand when the first command is created, using the
+// given name as the base for the temporary directory (see embed_util.NewEmbeddedFiles). Adding the same files
+// multiple times has no effect. The extracted files are removed when Cleanup is called. If fsys is nil, which is the
+// case for generated data on platforms it was not generated for, ErrUnsupportedPlatform is returned.
+func (ep *EmbeddedPython) AddPythonPathFS(name string, fsys fs.FS) error {
+	if fsys == nil {
+		return fmt.Errorf("%w: no embedded files for %s on %s/%s", ErrUnsupportedPlatform, name, runtime.GOOS, runtime.GOARCH)
+	}
+	hash, err := embed_util.FilesHash(fsys)
+	if err != nil {
+		return err
+	}
+
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+
+	if ep.fsHashes[hash] {
+		return nil
+	}
+	if ep.fsHashes == nil {
+		ep.fsHashes = map[string]bool{}
+	}
+	ep.fsHashes[hash] = true
+
+	ep.Python.(*python).addLazyPythonPath(func() ([]string, []string, error) {
+		e, err := embed_util.NewEmbeddedFiles(fsys, name, ep.Python.(*python).embeddedFilesOpts()...)
+		if err != nil {
+			return nil, nil, err
+		}
+		ep.mutex.Lock()
+		ep.extraFiles = append(ep.extraFiles, e)
+		ep.mutex.Unlock()
+		return append([]string{e.GetExtractedPath()}, e.GetZipImportPaths()...), []string{e.GetExtractedPath()}, nil
+	})
+	return nil
+}
+
+// Derive returns a copy of ep with the given options applied, see Python.With. Unlike With, it keeps the
+// *EmbeddedPython type. The copy shares the extracted distribution and the files added via AddPythonPathFS so far with
+// ep, so it is only usable as long as ep has not been cleaned up. Cleanup on the copy only removes files extracted due
+// to AddPythonPathFS calls made on the copy itself.
+func (ep *EmbeddedPython) Derive(opts ...PythonOpt) *EmbeddedPython {
+	ep.mutex.Lock()
+	fsHashes := maps.Clone(ep.fsHashes)
+	ep.mutex.Unlock()
+
+	return &EmbeddedPython{
+		e:        ep.e,
+		Python:   ep.Python.With(opts...),
+		derived:  true,
+		fsHashes: fsHashes,
+	}
+}
+
+func (ep *EmbeddedPython) With(opts ...PythonOpt) Python {
+	return ep.Derive(opts...)
+}
+
+// Cleanup removes the extracted distribution and all files extracted due to AddPythonPathFS. Files that are still in
+// use by other instances, e.g. in other processes, are kept (see embed_util.EmbeddedFiles.Cleanup).
 func (ep *EmbeddedPython) Cleanup() error {
-	return ep.e.Cleanup()
+	ep.mutex.Lock()
+	extraFiles := ep.extraFiles
+	ep.extraFiles = nil
+	ep.mutex.Unlock()
+
+	var errs []error
+	for _, e := range extraFiles {
+		errs = append(errs, e.Cleanup())
+	}
+	if ep.e != nil && !ep.derived {
+		errs = append(errs, ep.e.Cleanup())
+	}
+	return errors.Join(errs...)
 }
 
 func (ep *EmbeddedPython) GetExtractedPath() string {
+	if ep.e == nil {
+		return ""
+	}
 	return ep.e.GetExtractedPath()
 }
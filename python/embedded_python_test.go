@@ -1,13 +1,24 @@
 package python
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/kluctl/go-embed-python/embed_util"
 	"github.com/kluctl/go-embed-python/internal"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"io/fs"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestEmbeddedPython(t *testing.T) {
@@ -81,3 +92,369 @@ print("platform.processor=" + platform.processor())
 	err = cmd.Wait()
 	assert.NoError(t, err)
 }
+
+func TestCreateVenv(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	seedDir := t.TempDir()
+	err = os.WriteFile(filepath.Join(seedDir, "seeded.py"), []byte("x = 42\n"), 0o644)
+	assert.NoError(t, err)
+
+	venvDir := filepath.Join(t.TempDir(), "venv")
+	venv, err := ep.CreateVenv(venvDir, VenvOptions{
+		SeedPaths: []string{seedDir},
+	})
+	assert.NoError(t, err)
+
+	res, err := venv.Run(context.Background(), RunSpec{
+		Code: "import sys, seeded; print(sys.prefix); print(seeded.x)",
+	})
+	assert.NoError(t, err, string(res.Stderr))
+	assert.Equal(t, venvDir+"\n42\n", string(res.Stdout))
+}
+
+func TestVersion(t *testing.T) {
+	evi, err := EmbeddedVersion()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, evi.StandaloneVersion)
+	assert.NotEmpty(t, evi.Target)
+	assert.NotEmpty(t, evi.Flavor)
+
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	vi, err := ep.Version(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, evi.PythonVersion, vi.String())
+	assert.True(t, vi.AtLeast(3, 0))
+	assert.False(t, vi.AtLeast(vi.Major, vi.Minor+1))
+}
+
+func TestFallbackPython(t *testing.T) {
+	_, err := newFallbackPython(nil)
+	assert.True(t, errors.Is(err, ErrUnsupportedPlatform))
+
+	ep, err := newFallbackPython([]PythonOpt{WithSystemPythonFallback()})
+	assert.NoError(t, err)
+	assert.True(t, ep.IsFallback())
+	assert.Equal(t, "", ep.GetExtractedPath())
+
+	// the data generated for other platforms
+	var data fs.FS
+	err = ep.AddPythonPathFS("test-nil", data)
+	assert.True(t, errors.Is(err, ErrUnsupportedPlatform))
+	assert.NoError(t, ep.Cleanup())
+
+	res, err := ep.Run(context.Background(), RunSpec{Code: "print('test')"})
+	assert.NoError(t, err)
+	assert.Equal(t, "test\n", string(res.Stdout))
+}
+
+func TestAddPythonPathFS(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	fsys := fstest.MapFS{
+		"mymod/__init__.py": &fstest.MapFile{Data: []byte("x = 42\n"), Mode: 0o644},
+	}
+	err = ep.AddPythonPathFS(rndName+"-mymod", fsys)
+	assert.NoError(t, err)
+	err = ep.AddPythonPathFS(rndName+"-mymod2", fsys)
+	assert.NoError(t, err)
+
+	res, err := ep.Run(context.Background(), RunSpec{
+		Code: "import os, sys, mymod; print(mymod.x); print(len([p for p in os.environ['PYTHONPATH'].split(os.pathsep) if 'mymod' in p]))",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "42\n1\n", string(res.Stdout))
+
+	assert.Len(t, ep.extraFiles, 1)
+	extractedPath := ep.extraFiles[0].GetExtractedPath()
+	assert.True(t, internal.Exists(extractedPath))
+	assert.NoError(t, ep.Cleanup())
+	assert.False(t, internal.Exists(extractedPath))
+}
+
+func TestEmbeddedPythonDerive(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	var p Python = ep
+	_, ok := p.With(WithEnv("MY_VAR=x")).(*EmbeddedPython)
+	assert.True(t, ok)
+
+	ep2 := ep.Derive(WithEnv("MY_VAR=x"))
+	assert.Equal(t, ep.GetExtractedPath(), ep2.GetExtractedPath())
+
+	fsys := fstest.MapFS{
+		"mymod/__init__.py": &fstest.MapFile{Data: []byte("x = 42\n"), Mode: 0o644},
+	}
+	err = ep2.AddPythonPathFS(rndName+"-mymod", fsys)
+	assert.NoError(t, err)
+
+	res, err := ep2.Run(context.Background(), RunSpec{
+		Code: "import os, mymod; print(mymod.x, os.environ['MY_VAR'])",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "42 x\n", string(res.Stdout))
+
+	res, err = ep.Run(context.Background(), RunSpec{
+		Code: "import importlib.util; print(importlib.util.find_spec('mymod'))",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "None\n", string(res.Stdout))
+
+	// cleaning up the copy only removes its own files
+	assert.Len(t, ep2.extraFiles, 1)
+	extractedPath := ep2.extraFiles[0].GetExtractedPath()
+	assert.NoError(t, ep2.Cleanup())
+	assert.False(t, internal.Exists(extractedPath))
+	assert.True(t, internal.Exists(ep.GetExtractedPath()))
+
+	_, err = ep.Run(context.Background(), RunSpec{Code: "pass"})
+	assert.NoError(t, err)
+}
+
+func TestAddPythonPathFSZipImport(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	srcDir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(srcDir, "zipped"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "zipped", "__init__.py"), []byte("x = 1\n"), 0o644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(srcDir, "withdata"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "withdata", "__init__.py"), []byte("x = 2\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "withdata", "data.txt"), []byte("data"), 0o644))
+
+	outDir := filepath.Join(t.TempDir(), "out")
+	err = embed_util.CopyForEmbed(outDir, srcDir, embed_util.WithZipImport(".", "packages.zip"))
+	assert.NoError(t, err)
+	assert.True(t, internal.Exists(filepath.Join(outDir, "packages.zip")))
+	assert.False(t, internal.Exists(filepath.Join(outDir, "zipped")))
+	assert.True(t, internal.Exists(filepath.Join(outDir, "withdata", "data.txt")))
+
+	err = ep.AddPythonPathFS(rndName+"-zip", os.DirFS(outDir))
+	assert.NoError(t, err)
+
+	res, err := ep.Run(context.Background(), RunSpec{
+		Code: "import zipped, withdata; print(zipped.x, withdata.x); print('.zip' in zipped.__file__)",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "1 2\nTrue\n", string(res.Stdout))
+}
+
+func TestAddPythonPathFSCompileBytecode(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	exePath, err := ep.GetExePath()
+	assert.NoError(t, err)
+
+	srcDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "top.py"), []byte("x = 1\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "invalid.py"), []byte("print 'python 2'\n"), 0o644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(srcDir, "zipped"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "zipped", "__init__.py"), []byte("x = 2\n"), 0o644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(srcDir, "withdata"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "withdata", "__init__.py"), []byte("x = 3\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "withdata", "data.txt"), []byte("data"), 0o644))
+
+	outDir := filepath.Join(t.TempDir(), "out")
+	err = embed_util.CopyForEmbed(outDir, srcDir, embed_util.WithCompileBytecode(exePath), embed_util.WithZipImport(".", "packages.zip"))
+	assert.NoError(t, err)
+
+	pycs, err := filepath.Glob(filepath.Join(outDir, "withdata", "__pycache__", "__init__.*.pyc*"))
+	assert.NoError(t, err)
+	assert.Len(t, pycs, 1)
+
+	z, err := zip.OpenReader(filepath.Join(outDir, "packages.zip"))
+	assert.NoError(t, err)
+	var zipNames []string
+	for _, f := range z.File {
+		zipNames = append(zipNames, f.Name)
+	}
+	_ = z.Close()
+	assert.Subset(t, zipNames, []string{"top.py", "top.pyc", "zipped/__init__.py", "zipped/__init__.pyc"})
+	assert.NotContains(t, zipNames, "invalid.pyc")
+
+	err = ep.AddPythonPathFS(rndName+"-pyc", os.DirFS(outDir))
+	assert.NoError(t, err)
+
+	res, err := ep.With(WithDontWriteBytecode(true)).Run(context.Background(), RunSpec{
+		Code: "import os, top, zipped, withdata; print(top.x, zipped.x, withdata.x); print(os.path.exists(withdata.__cached__), zipped.__file__.endswith('.pyc'))",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "1 2 3\nTrue True\n", string(res.Stdout))
+}
+
+func TestPycachePrefix(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	srcDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "mymod.py"), []byte("x = 1\n"), 0o644))
+
+	prefix := t.TempDir()
+	// writing bytecode might be disabled in the environment of the test
+	p := ep.With(WithPycachePrefix(prefix), WithPythonPath(srcDir), WithEnv("PYTHONDONTWRITEBYTECODE="))
+	res, err := p.Run(context.Background(), RunSpec{
+		Code: "import mymod; print(mymod.__cached__.startswith(__import__('sys').pycache_prefix))",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "True\n", string(res.Stdout))
+
+	var pycs []string
+	_ = filepath.Walk(prefix, func(path string, info os.FileInfo, err error) error {
+		if err == nil && filepath.Ext(path) == ".pyc" && strings.HasPrefix(filepath.Base(path), "mymod.") {
+			pycs = append(pycs, path)
+		}
+		return nil
+	})
+	assert.Len(t, pycs, 1)
+	assert.False(t, internal.Exists(filepath.Join(srcDir, "__pycache__")))
+}
+
+func TestEmbeddedPythonChildUsage(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "solaris" || runtime.GOOS == "illumos" || runtime.GOOS == "aix" {
+		t.Skip("usage locks are not inherited without flock")
+	}
+
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	fsys := fstest.MapFS{"mymod.py": &fstest.MapFile{Data: []byte("x = 1\n"), Mode: 0o644}}
+	assert.NoError(t, ep.AddPythonPathFS(rndName+"-mymod", fsys))
+
+	cmd, err := ep.Command(context.Background(), "-c", "import sys, mymod; print('started', flush=True); sys.stdin.read()")
+	assert.NoError(t, err)
+	stdin, err := cmd.StdinPipe()
+	assert.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, cmd.Start())
+
+	s := bufio.NewScanner(stdout)
+	assert.True(t, s.Scan())
+	assert.Equal(t, "started", s.Text())
+
+	// the running interpreter keeps the extracted files alive
+	pythonHome := ep.GetExtractedPath()
+	modPath := ep.extraFiles[0].GetExtractedPath()
+	assert.NoError(t, ep.Cleanup())
+	assert.True(t, internal.Exists(pythonHome))
+	assert.True(t, internal.Exists(modPath))
+
+	assert.NoError(t, stdin.Close())
+	assert.NoError(t, cmd.Wait())
+
+	ep2, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	assert.NoError(t, ep2.Cleanup())
+	assert.False(t, internal.Exists(pythonHome))
+	e, err := embed_util.NewEmbeddedFiles(fsys, rndName+"-mymod")
+	assert.NoError(t, err)
+	assert.NoError(t, e.Cleanup())
+	assert.False(t, internal.Exists(modPath))
+}
+
+// TestRepackedDistribution packs the embedded distribution with all packer features and runs the interpreter from the
+// extracted result, as the embedded data itself might have been packed by an older version.
+func TestRepackedDistribution(t *testing.T) {
+	if testing.Short() {
+		t.Skip("packs the whole distribution")
+	}
+
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+	if ep.IsFallback() {
+		t.Skip("no embedded distribution")
+	}
+
+	v, err := ep.Version(context.Background())
+	assert.NoError(t, err)
+	versionBase := fmt.Sprintf("%d.%d", v.Major, v.Minor)
+
+	srcDir := filepath.Join(t.TempDir(), "src")
+	assert.NoError(t, internal.CopyDir(ep.GetExtractedPath(), srcDir))
+
+	zipName := fmt.Sprintf("python%s.zip", strings.ReplaceAll(versionBase, ".", ""))
+	libDir, zipPath, exePath := "Lib", zipName, filepath.Join(srcDir, "python.exe")
+	if runtime.GOOS != "windows" {
+		libDir = filepath.Join("lib", "python"+versionBase)
+		zipPath = filepath.Join("lib", zipName)
+		exePath = filepath.Join(srcDir, "bin", "python3")
+	}
+
+	outDir := filepath.Join(t.TempDir(), "out")
+	err = embed_util.CopyForEmbed(outDir, srcDir,
+		embed_util.WithZipImport(libDir, zipPath),
+		embed_util.WithCompileBytecode(exePath),
+		embed_util.WithCodec(embed_util.CodecZstd),
+		embed_util.WithCompressionPolicy(embed_util.CompressAll),
+		embed_util.WithCompressionLevel(1))
+	assert.NoError(t, err)
+
+	tmpDir := filepath.Join(t.TempDir(), "python")
+	e, err := embed_util.NewEmbeddedFilesWithTmpDir(os.DirFS(outDir), tmpDir, true)
+	assert.NoError(t, err)
+	defer e.Cleanup()
+	assert.Equal(t, []string{filepath.Join(e.GetExtractedPath(), zipPath)}, e.GetZipImportPaths())
+
+	script := `
+import json, os, sys, ssl, zipimport
+print(sys.version_info[:2] == tuple(int(x) for x in sys.argv[1].split(".")))
+print(isinstance(json.__loader__, zipimport.zipimporter), json.__file__.endswith(".pyc"))
+print(os.path.realpath(sys.prefix) == os.path.realpath(sys.argv[2]))
+`
+	rp := newEmbeddedPython(e, nil)
+	res, err := rp.Run(context.Background(), RunSpec{
+		Code: script,
+		Args: []string{versionBase, e.GetExtractedPath()},
+	})
+	assert.NoError(t, err, string(res.Stderr))
+	assert.Equal(t, "True\nTrue True\nTrue\n", string(res.Stdout))
+
+	report, err := e.Verify()
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+
+	// tampered files are detected via their hashes and repaired by VerifyHash
+	zipFile := filepath.Join(e.GetExtractedPath(), zipPath)
+	data, err := os.ReadFile(zipFile)
+	assert.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	assert.NoError(t, os.WriteFile(zipFile, data, 0o644))
+
+	report, err = e.Verify()
+	assert.NoError(t, err)
+	assert.False(t, report.OK())
+
+	e2, err := embed_util.NewEmbeddedFilesWithTmpDir(os.DirFS(outDir), tmpDir, true, embed_util.WithVerifyMode(embed_util.VerifyHash))
+	assert.NoError(t, err)
+	defer e2.Cleanup()
+	report, err = e2.Verify()
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+
+	res, err = newEmbeddedPython(e2, nil).Run(context.Background(), RunSpec{Code: script, Args: []string{versionBase, e2.GetExtractedPath()}})
+	assert.NoError(t, err, string(res.Stderr))
+}
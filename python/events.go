@@ -0,0 +1,67 @@
+package python
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// eventPipeDrainTimeout is the time given to descendants of the interpreter that inherited the event pipe to close it
+const eventPipeDrainTimeout = time.Second
+
+// launcherEvent is a single JSON line written by launcher.py to the event pipe
+type launcherEvent struct {
+	Type  string      `json:"type"`
+	Audit *AuditEvent `json:"audit,omitempty"`
+	Log   *LogRecord  `json:"log,omitempty"`
+}
+
+// eventPipe receives events from launcher.py. The write end of the pipe is inherited by the interpreter via
+// ExtraFiles, see Cmd.Start.
+type eventPipe struct {
+	r    *os.File
+	done chan struct{}
+}
+
+// newEventPipe starts reading events from r. The interpreter must already have been started and the write end must
+// not be open in this process anymore, as reading only stops when all copies of the write end are closed.
+func newEventPipe(r *os.File, handle func(e *launcherEvent)) *eventPipe {
+	p := &eventPipe{
+		r:    r,
+		done: make(chan struct{}),
+	}
+	go p.readLoop(handle)
+	return p
+}
+
+func (p *eventPipe) readLoop(handle func(e *launcherEvent)) {
+	defer close(p.done)
+
+	s := bufio.NewScanner(p.r)
+	s.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		var e launcherEvent
+		err := json.Unmarshal(s.Bytes(), &e)
+		if err != nil {
+			log.Warningf("failed to parse event from python launcher: %v", err)
+			continue
+		}
+		handle(&e)
+	}
+}
+
+// wait must be called after the interpreter has exited. It waits for all pending events to be handled and closes the
+// pipe.
+func (p *eventPipe) wait() {
+	select {
+	case <-p.done:
+	case <-time.After(eventPipeDrainTimeout):
+		// a descendant still holds the pipe open
+		_ = p.r.Close()
+		<-p.done
+	}
+	_ = p.r.Close()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/gobwas/glob"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 )
@@ -22,6 +24,11 @@ var (
 	preparePath             = flag.String("prepare-path", filepath.Join(os.TempDir(), "python-download"), "specify the path where the python executables are downloaded and prepared. automatically creates a temporary directory if unset")
 	runPrepare              = flag.Bool("prepare", true, "if set, python executables will be downloaded and prepared for packing at the configured path")
 	runPack                 = flag.Bool("pack", true, "if set, previously prepared python executables will be packed into their redistributable form")
+	zipImport               = flag.Bool("zipimport", false, "if set, the pure-Python part of the standard library is packed into a zip file which is imported via zipimport at runtime")
+	compileBytecode         = flag.Bool("compile-bytecode", false, "if set, the standard library is compiled to bytecode while packing. this is only possible for the platform matching the host, other platforms are packed without bytecode")
+	codec                   = flag.String("codec", string(embed_util.CodecGzip), "specify the codec used to compress embedded files. one of gzip or zstd")
+	compressAll             = flag.Bool("compress-all", false, "if set, text files like .py sources are compressed as well. otherwise only binary files are compressed")
+	compressionLevel        = flag.Int("compression-level", 0, "specify the compression level, which is interpreted by the codec. uses the best compression of the codec if unset")
 	pythonVersionBase       string
 )
 
@@ -76,31 +83,44 @@ func main() {
 	type job struct {
 		os           string
 		arch         string
-		dist         string
+		platform     string
+		flavor       string
 		keepPatterns []glob.Glob
 	}
 
 	jobs := []job{
-		{"linux", "amd64", "unknown-linux-gnu-pgo+lto-full", keepNixPatterns},
-		{"linux", "arm64", "unknown-linux-gnu-lto-full", keepNixPatterns},
-		{"darwin", "amd64", "apple-darwin-pgo+lto-full", keepNixPatterns},
-		{"darwin", "arm64", "apple-darwin-pgo+lto-full", keepNixPatterns},
-		{"windows", "amd64", "pc-windows-msvc-shared-pgo-full", keepWinPatterns},
+		{"linux", "amd64", "unknown-linux-gnu", "pgo+lto-full", keepNixPatterns},
+		{"linux", "arm64", "unknown-linux-gnu", "lto-full", keepNixPatterns},
+		{"darwin", "amd64", "apple-darwin", "pgo+lto-full", keepNixPatterns},
+		{"darwin", "arm64", "apple-darwin", "pgo+lto-full", keepNixPatterns},
+		{"windows", "amd64", "pc-windows-msvc", "shared-pgo-full", keepWinPatterns},
 	}
 	for _, j := range jobs {
 		j := j
 		wg.Add(1)
 		go func() {
+			dist := fmt.Sprintf("%s-%s", j.platform, j.flavor)
 			if *runPrepare {
-				downloadAndPrepare(j.os, j.arch, j.dist, j.keepPatterns)
+				downloadAndPrepare(j.os, j.arch, dist, j.keepPatterns)
 			}
 			if *runPack {
-				packPrepared(j.os, j.arch, j.dist, targetPath)
+				packPrepared(j.os, j.arch, j.platform, j.flavor, targetPath)
 			}
 			wg.Done()
 		}()
 	}
 	wg.Wait()
+
+	if *runPack {
+		var platforms []string
+		for _, j := range jobs {
+			platforms = append(platforms, fmt.Sprintf("%s-%s", j.os, j.arch))
+		}
+		err := embed_util.WriteFallbackEmbedGoFile(targetPath, platforms)
+		if err != nil {
+			panic(err)
+		}
+	}
 }
 
 func downloadAndPrepare(osName string, arch string, dist string, keepPatterns []glob.Glob) {
@@ -133,10 +153,33 @@ func downloadAndPrepare(osName string, arch string, dist string, keepPatterns []
 	}
 }
 
-func packPrepared(osName string, arch string, dist string, targetPath string) {
-	extractPath := generateDownloadPath(arch, dist) + ".extracted"
+func packPrepared(osName string, arch string, platform string, flavor string, targetPath string) {
+	extractPath := generateDownloadPath(arch, fmt.Sprintf("%s-%s", platform, flavor)) + ".extracted"
 	installPath := filepath.Join(extractPath, "python", "install")
-	err := embed_util.CopyForEmbed(filepath.Join(targetPath, fmt.Sprintf("%s-%s", osName, arch)), installPath)
+	platformTargetPath := filepath.Join(targetPath, fmt.Sprintf("%s-%s", osName, arch))
+	copyOpts := []embed_util.CopyOpt{
+		embed_util.WithCodec(embed_util.Codec(*codec)),
+		embed_util.WithCompressionLevel(*compressionLevel),
+	}
+	if *compressAll {
+		copyOpts = append(copyOpts, embed_util.WithCompressionPolicy(embed_util.CompressAll))
+	}
+	if *zipImport {
+		copyOpts = append(copyOpts, stdlibZipImport(osName))
+	}
+	if *compileBytecode {
+		if osName == runtime.GOOS && arch == runtime.GOARCH {
+			copyOpts = append(copyOpts, embed_util.WithCompileBytecode(preparedExePath(osName, installPath)))
+		} else {
+			log.Infof("not compiling bytecode for %s-%s as it does not match the host", osName, arch)
+		}
+	}
+	err := embed_util.CopyForEmbed(platformTargetPath, installPath, copyOpts...)
+	if err != nil {
+		panic(err)
+	}
+
+	err = writeVersionInfo(platformTargetPath, fmt.Sprintf("%s-%s", archMapping[arch], platform), flavor)
 	if err != nil {
 		panic(err)
 	}
@@ -157,6 +200,39 @@ func packPrepared(osName string, arch string, dist string, targetPath string) {
 	}
 }
 
+// stdlibZipImport returns the zip import option for the standard library. The zip file is placed where the
+// interpreter expects it by default, so that it's also found when running inside a venv.
+func stdlibZipImport(osName string) embed_util.CopyOpt {
+	zipName := fmt.Sprintf("python%s.zip", strings.ReplaceAll(pythonVersionBase, ".", ""))
+	if osName == "windows" {
+		return embed_util.WithZipImport("Lib", zipName)
+	}
+	return embed_util.WithZipImport(filepath.Join("lib", fmt.Sprintf("python%s", pythonVersionBase)), filepath.Join("lib", zipName))
+}
+
+// preparedExePath returns the path of the interpreter inside the prepared distribution
+func preparedExePath(osName string, installPath string) string {
+	if osName == "windows" {
+		return filepath.Join(installPath, "python.exe")
+	}
+	return filepath.Join(installPath, "bin", "python3")
+}
+
+// writeVersionInfo writes the version.json file that is read by python.EmbeddedVersion(). It is not part of
+// files.json, so it is only embedded but never extracted.
+func writeVersionInfo(platformTargetPath string, target string, flavor string) error {
+	b, err := json.MarshalIndent(map[string]string{
+		"pythonVersion":           *pythonVersion,
+		"pythonStandaloneVersion": *pythonStandaloneVersion,
+		"target":                  target,
+		"flavor":                  flavor,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(platformTargetPath, "version.json"), b, 0o644)
+}
+
 func generateDownloadPath(arch string, dist string) string {
 	pythonArch, ok := archMapping[arch]
 	if !ok {
@@ -0,0 +1,97 @@
+package python
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+//go:embed launcher.py
+var launcherSource string
+
+const launcherFilename = "<go-embed-python-launcher>"
+
+// launcherConfig is passed as JSON to launcher.py
+type launcherConfig struct {
+	// Program is the part of the original arguments that follows the interpreter options, e.g. ["-c", "code", "arg"]
+	Program []string `json:"program"`
+	// EventFd is the file descriptor of the event pipe inside the interpreter, see Cmd.Start
+	EventFd int            `json:"eventFd,omitempty"`
+	Sandbox *sandboxConfig `json:"sandbox,omitempty"`
+	Audit   *auditConfig   `json:"audit,omitempty"`
+	Logging bool           `json:"logging,omitempty"`
+}
+
+// launcherArgs rewrites the given interpreter arguments so that launcher.py is executed in front of the original
+// program. Interpreter options are kept as they are.
+func launcherArgs(args []string, cfg launcherConfig) ([]string, error) {
+	interpreterArgs, program := splitInterpreterArgs(args)
+	cfg.Program = program
+
+	cfgJson, err := json.Marshal(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	// the launcher is executed in its own namespace, so that nothing leaks into __main__
+	src, err := json.Marshal(launcherSource)
+	if err != nil {
+		return nil, err
+	}
+	stub := fmt.Sprintf("exec(compile(%s, %q, \"exec\"), {\"__name__\": \"__go_embed_python_launcher__\"})", src, launcherFilename)
+
+	ret := append([]string{}, interpreterArgs...)
+	ret = append(ret, "-c", stub, string(cfgJson))
+	return ret, nil
+}
+
+// splitInterpreterArgs splits the given command line into the interpreter options and the program part, which starts
+// with -c, -m, - or the script path. Grouped short options like "-Bc" are split up.
+func splitInterpreterArgs(args []string) ([]string, []string) {
+	var interpreterArgs []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--":
+			return interpreterArgs, args[i+1:]
+		case a == "--check-hash-based-pycs":
+			interpreterArgs = append(interpreterArgs, args[i:min(i+2, len(args))]...)
+			i++
+			continue
+		case strings.HasPrefix(a, "--"):
+			interpreterArgs = append(interpreterArgs, a)
+			continue
+		case a == "-" || !strings.HasPrefix(a, "-"):
+			return interpreterArgs, args[i:]
+		}
+
+		for j := 1; j < len(a); j++ {
+			c := a[j]
+			if c != 'c' && c != 'm' && c != 'W' && c != 'X' {
+				continue
+			}
+			if j > 1 {
+				interpreterArgs = append(interpreterArgs, a[:j])
+			}
+			// the option argument is either attached or the next argument
+			var optArg []string
+			if j+1 < len(a) {
+				optArg = []string{a[j+1:]}
+			} else if i+1 < len(args) {
+				i++
+				optArg = []string{args[i]}
+			}
+			opt := append([]string{"-" + string(c)}, optArg...)
+			if c == 'c' || c == 'm' {
+				return interpreterArgs, append(opt, args[i+1:]...)
+			}
+			interpreterArgs = append(interpreterArgs, opt...)
+			a = ""
+			break
+		}
+		if a != "" {
+			interpreterArgs = append(interpreterArgs, a)
+		}
+	}
+	return interpreterArgs, nil
+}
@@ -0,0 +1,369 @@
+# Bootstrap that is injected in front of the actual program when the interpreter needs to be prepared before any user
+# code runs, e.g. for python.Sandbox, python.AuditPolicy and log forwarding. It is executed via -c in its own
+# namespace, receives its configuration as JSON in sys.argv[1] and then runs the original program (-c, -m, a script or
+# stdin) the same way the interpreter would.
+#
+# Events like denied audit events and log records are sent back to Go as JSON lines through the write end of a pipe
+# that is inherited from the Go process. Its file descriptor is passed as eventFd in the configuration, which is 3
+# unless other files are passed to the interpreter as well. The launcher makes it non-inheritable before doing
+# anything else, so that it is not passed on to child processes.
+import errno
+import json
+import os
+import sys
+import threading
+
+_LAUNCHER_FILENAME = "<go-embed-python-launcher>"
+_SETUP_FAILED_PREFIX = "go-embed-python: sandbox setup failed: "
+_SETUP_FAILED_EXIT_CODE = 126
+
+MS_RDONLY = 1
+MS_NOSUID = 2
+MS_NODEV = 4
+MS_NOEXEC = 8
+MS_REMOUNT = 32
+MS_NOATIME = 1024
+MS_NODIRATIME = 2048
+MS_BIND = 4096
+MS_REC = 16384
+MS_PRIVATE = 1 << 18
+MS_RELATIME = 1 << 21
+
+ST_RELATIME = 4096
+
+PR_CAPBSET_DROP = 24
+PR_SET_SECUREBITS = 28
+PR_SET_NO_NEW_PRIVS = 38
+PR_CAP_AMBIENT = 47
+PR_CAP_AMBIENT_CLEAR_ALL = 4
+
+# SECBIT_NOROOT, SECBIT_NO_SETUID_FIXUP and SECBIT_KEEP_CAPS_LOCKED, including the locks of the first two
+_SECUREBITS = 0x2f
+
+_WRITE_FLAGS = os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREAT | os.O_TRUNC
+
+_event_fd = None
+_event_lock = threading.Lock()
+
+
+def _setup_events(fd):
+    global _event_fd
+    # child processes must not keep the pipe open
+    os.set_inheritable(fd, False)
+    _event_fd = fd
+
+
+def _send_event(e):
+    global _event_fd
+    if _event_fd is None:
+        return
+    data = (json.dumps(e) + "\n").encode()
+    with _event_lock:
+        try:
+            while data:
+                data = data[os.write(_event_fd, data):]
+        except OSError:
+            _event_fd = None
+
+
+def _to_json(v, depth=0):
+    if v is None or isinstance(v, (bool, int, float, str)):
+        return v
+    if isinstance(v, bytes):
+        return os.fsdecode(v)
+    if depth < 4:
+        if isinstance(v, (list, tuple)):
+            return [_to_json(x, depth + 1) for x in v]
+        if isinstance(v, dict):
+            return {str(k): _to_json(x, depth + 1) for k, x in v.items()}
+    return repr(v)
+
+
+def _libc():
+    import ctypes
+    libc = ctypes.CDLL(None, use_errno=True)
+    libc.mount.argtypes = [ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_ulong, ctypes.c_char_p]
+    libc.prctl.argtypes = [ctypes.c_int, ctypes.c_ulong, ctypes.c_ulong, ctypes.c_ulong, ctypes.c_ulong]
+    return libc
+
+
+def _check(ret, what):
+    if ret != 0:
+        import ctypes
+        e = ctypes.get_errno()
+        raise OSError(e, "%s: %s" % (what, os.strerror(e)))
+
+
+def _mount(libc, source, target, fstype, flags, data):
+    _check(libc.mount(source and os.fsencode(source), os.fsencode(target), fstype and fstype.encode(), flags,
+                      data and data.encode()), "mount %s" % target)
+
+
+def _locked_flags(st):
+    # flags of the original mount must be preserved when remounting inside a user namespace
+    flags = st.f_flag & (MS_NOSUID | MS_NODEV | MS_NOEXEC | MS_NOATIME | MS_NODIRATIME)
+    if st.f_flag & ST_RELATIME:
+        flags |= MS_RELATIME
+    return flags
+
+
+def _setup_mounts(libc, cfg):
+    import stat
+
+    _mount(libc, None, "/", None, MS_REC | MS_PRIVATE, None)
+
+    # the read-only paths might be hidden by the scratch dir, so we keep a reference to them
+    fds = []
+    for p in cfg.get("readOnly") or []:
+        if os.path.exists(p):
+            fds.append((p, os.open(p, os.O_PATH)))
+
+    scratch = cfg.get("scratch")
+    if scratch:
+        data = "mode=1777"
+        if cfg.get("scratchSize"):
+            data += ",size=%d" % cfg["scratchSize"]
+        _mount(libc, "tmpfs", scratch, "tmpfs", MS_NOSUID | MS_NODEV, data)
+
+    for p, fd in fds:
+        if not os.path.exists(p):
+            if stat.S_ISDIR(os.fstat(fd).st_mode):
+                os.makedirs(p)
+            else:
+                os.makedirs(os.path.dirname(p), exist_ok=True)
+                open(p, "w").close()
+        _mount(libc, "/proc/self/fd/%d" % fd, p, None, MS_BIND | MS_REC, None)
+        os.close(fd)
+        _mount(libc, None, p, None, MS_REMOUNT | MS_BIND | MS_RDONLY | _locked_flags(os.statvfs(p)), None)
+
+    if cfg.get("proc"):
+        _mount(libc, "proc", "/proc", "proc", MS_NOSUID | MS_NODEV | MS_NOEXEC, None)
+
+
+def _drop_caps(libc):
+    import ctypes
+
+    with open("/proc/sys/kernel/cap_last_cap") as f:
+        last_cap = int(f.read())
+
+    _check(libc.prctl(PR_SET_SECUREBITS, _SECUREBITS, 0, 0, 0), "prctl(PR_SET_SECUREBITS)")
+    for cap in range(last_cap + 1):
+        _check(libc.prctl(PR_CAPBSET_DROP, cap, 0, 0, 0), "prctl(PR_CAPBSET_DROP)")
+    _check(libc.prctl(PR_CAP_AMBIENT, PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0), "prctl(PR_CAP_AMBIENT)")
+
+    # _LINUX_CAPABILITY_VERSION_3 with empty effective, permitted and inheritable sets
+    header = (ctypes.c_uint32 * 2)(0x20080522, 0)
+    data = (ctypes.c_uint32 * 6)()
+    _check(libc.capset(header, data), "capset")
+
+
+def _setup_sandbox(cfg):
+    if cfg.get("mounts") or cfg.get("dropCaps"):
+        libc = _libc()
+        if cfg.get("mounts"):
+            _setup_mounts(libc, cfg["mounts"])
+        if cfg.get("dropCaps"):
+            _drop_caps(libc)
+        _check(libc.prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0), "prctl(PR_SET_NO_NEW_PRIVS)")
+
+    rlimits = cfg.get("rlimits")
+    if rlimits:
+        import resource
+        for name, v in rlimits.items():
+            resource.setrlimit(getattr(resource, name), (v, v))
+
+
+def _setup_audit(cfg):
+    events = cfg.get("events") or {}
+    file_write = cfg.get("fileWrite") or "allow"
+    allowed_dirs = [os.path.realpath(d) for d in cfg.get("allowedWriteDirs") or []]
+    state = threading.local()
+
+    def is_write(mode, flags):
+        if isinstance(mode, str):
+            return any(c in mode for c in "wax+")
+        return isinstance(flags, int) and flags & _WRITE_FLAGS != 0
+
+    def is_allowed_path(path):
+        if isinstance(path, int):
+            # already opened file descriptors
+            return True
+        try:
+            p = os.path.realpath(os.fsdecode(path))
+        except (TypeError, ValueError):
+            return False
+        return any(p == d or p.startswith(d + os.sep) for d in allowed_dirs)
+
+    def get_action(event, args):
+        action = events.get(event)
+        if action is None and event == "open" and file_write != "allow" and len(args) >= 3:
+            if is_write(args[1], args[2]) and not is_allowed_path(args[0]):
+                action = file_write
+        return action
+
+    def hook(event, args):
+        # the hook itself might cause audit events
+        if getattr(state, "active", False):
+            return
+        state.active = True
+        try:
+            action = get_action(event, args)
+            if action is None or action == "allow":
+                return
+            _send_event({"type": "audit", "audit": {
+                "event": event,
+                "args": _to_json(args),
+                "denied": action == "deny",
+                "pid": os.getpid(),
+            }})
+        finally:
+            state.active = False
+        if action == "deny":
+            raise PermissionError(errno.EPERM, "denied by audit policy: %s" % event)
+
+    sys.addaudithook(hook)
+
+
+def _setup_logging():
+    import datetime
+    import logging
+
+    # attributes that every LogRecord has, everything else was passed via extra=
+    standard_attrs = set(logging.LogRecord("", 0, "", 0, "", None, None).__dict__)
+    standard_attrs.update(("message", "asctime", "taskName"))
+
+    class EventHandler(logging.Handler):
+        def emit(self, record):
+            try:
+                self.send(record)
+            except Exception:
+                self.handleError(record)
+
+        def send(self, record):
+            exc_info = None
+            if record.exc_info:
+                exc_info = logging.Formatter().formatException(record.exc_info)
+            elif record.exc_text:
+                exc_info = record.exc_text
+            extra = {k: _to_json(v) for k, v in record.__dict__.items() if k not in standard_attrs}
+            _send_event({"type": "log", "log": {
+                "time": datetime.datetime.fromtimestamp(record.created, datetime.timezone.utc).isoformat(),
+                "level": record.levelname,
+                "levelNo": record.levelno,
+                "logger": record.name,
+                "message": record.getMessage(),
+                "excInfo": exc_info,
+                "stackInfo": record.stack_info,
+                "extra": extra or None,
+                "pathname": record.pathname,
+                "lineno": record.lineno,
+                "pid": os.getpid(),
+            }})
+
+    handler = EventHandler()
+    root = logging.getLogger()
+    root.addHandler(handler)
+    logging.captureWarnings(True)
+
+    # basicConfig does nothing if the root logger already has handlers, so it must not see ours
+    orig_basic_config = logging.basicConfig
+
+    def basic_config(**kwargs):
+        root.removeHandler(handler)
+        try:
+            orig_basic_config(**kwargs)
+        finally:
+            root.addHandler(handler)
+
+    basic_config.__doc__ = orig_basic_config.__doc__
+    logging.basicConfig = basic_config
+
+
+def _load_program(program):
+    main = sys.modules["__main__"]
+    if not program or program[0] == "-":
+        sys.argv = program or [""]
+        return compile(sys.stdin.read(), "<stdin>", "exec"), main.__dict__
+    if program[0] == "-c":
+        sys.argv = ["-c"] + program[2:]
+        return compile(program[1], "<string>", "exec"), main.__dict__
+    if program[0] == "-m":
+        sys.argv = ["-m"] + program[2:]
+        if sys.path and sys.path[0] == "":
+            sys.path[0] = os.getcwd()
+        return None, program[1]
+
+    script = program[0]
+    sys.argv = list(program)
+    if sys.path and sys.path[0] == "":
+        sys.path[0] = os.path.dirname(os.path.realpath(script))
+    with open(script, "rb") as f:
+        code = compile(f.read(), script, "exec")
+    main.__file__ = script
+    return code, main.__dict__
+
+
+def _run(code, target):
+    try:
+        if code is None:
+            import runpy
+            runpy._run_module_as_main(target)
+        else:
+            exec(code, target)
+    except SystemExit:
+        raise
+    except BaseException as e:
+        tb = e.__traceback__
+        while tb is not None and tb.tb_frame.f_code.co_filename == _LAUNCHER_FILENAME:
+            tb = tb.tb_next
+        sys.excepthook(type(e), e.with_traceback(tb), tb)
+        if isinstance(e, KeyboardInterrupt):
+            _exit_sigint()
+        sys.exit(1)
+
+
+def _exit_sigint():
+    # like CPython, terminate via SIGINT after an unhandled KeyboardInterrupt, so that the parent can tell that the
+    # interpreter was interrupted
+    import atexit
+    import signal
+    atexit._run_exitfuncs()
+    for f in (sys.stdout, sys.stderr):
+        try:
+            f.flush()
+        except Exception:
+            pass
+    if os.name == "nt":
+        os._exit(0xC000013A)  # STATUS_CONTROL_C_EXIT
+    signal.signal(signal.SIGINT, signal.SIG_DFL)
+    os.kill(os.getpid(), signal.SIGINT)
+    # only reached if SIGINT is blocked
+    os._exit(130)
+
+
+def _main():
+    cfg = json.loads(sys.argv[1])
+    if cfg.get("eventFd"):
+        _setup_events(cfg["eventFd"])
+        if cfg.get("logging"):
+            _setup_logging()
+
+    # scripts are read before the sandbox is set up, as the scratch dir might hide them
+    code, target = _load_program(cfg["program"])
+
+    try:
+        if cfg.get("sandbox"):
+            _setup_sandbox(cfg["sandbox"])
+    except Exception as e:
+        sys.stderr.write("%s%s\n" % (_SETUP_FAILED_PREFIX, e))
+        sys.stderr.flush()
+        os._exit(_SETUP_FAILED_EXIT_CODE)
+
+    if cfg.get("audit"):
+        _setup_audit(cfg["audit"])
+
+    del cfg
+    _run(code, target)
+
+
+_main()
@@ -0,0 +1,92 @@
+package python
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Python log levels, see https://docs.python.org/3/library/logging.html#logging-levels
+const (
+	PythonLogDebug    = 10
+	PythonLogInfo     = 20
+	PythonLogWarning  = 30
+	PythonLogError    = 40
+	PythonLogCritical = 50
+)
+
+// LogRecord is a record emitted via the logging module of the interpreter.
+type LogRecord struct {
+	Time time.Time `json:"time"`
+	// Level is the name of the level, e.g. "WARNING".
+	Level string `json:"level"`
+	// LevelNo is the numeric level, see the PythonLog* constants.
+	LevelNo int    `json:"levelNo"`
+	Logger  string `json:"logger"`
+	// Message is the formatted message, without exception information.
+	Message string `json:"message"`
+	// ExcInfo contains the formatted traceback if the record was logged with exc_info.
+	ExcInfo string `json:"excInfo,omitempty"`
+	// StackInfo contains the formatted stack if the record was logged with stack_info.
+	StackInfo string `json:"stackInfo,omitempty"`
+	// Extra contains the attributes passed via extra=. Values that can't be represented in JSON are converted via
+	// repr().
+	Extra map[string]any `json:"extra,omitempty"`
+
+	Pathname string `json:"pathname"`
+	Lineno   int    `json:"lineno"`
+	// Pid is the pid of the process that emitted the record, as seen from inside the interpreter.
+	Pid int `json:"pid"`
+}
+
+// WithLogHandler installs a logging.Handler on the root logger of all interpreters started by the Python instance,
+// which forwards all records to h. Warnings are captured via logging.captureWarnings, so these are forwarded as well.
+//
+// The levels of the Python loggers still apply, so only warnings and above are forwarded unless the program configures
+// a lower level. As the root logger now has a handler, records are not printed to stderr anymore by the last resort
+// handler. logging.basicConfig keeps working as before.
+//
+// Records are only forwarded for interpreters started via Command, Run or a Worker, see Cmd. h is called from a
+// separate goroutine, but never concurrently for the same process. Records are passed through an inherited pipe, which
+// is not supported on Windows. The handler is not installed there.
+func WithLogHandler(h func(r LogRecord)) PythonOpt {
+	return func(o *python) {
+		o.logHandlers = append(o.logHandlers, h)
+	}
+}
+
+// WithLogrusLogging forwards all Python log records to the given logger, see WithLogHandler. Python levels are mapped
+// to the corresponding logrus levels, with CRITICAL being mapped to Error. The entries have the fields "logger" and
+// "pid", the traceback in "exc_info" and all extras passed to the Python logger. Like WithLogHandler, this has no
+// effect on Windows.
+func WithLogrusLogging(logger log.FieldLogger) PythonOpt {
+	return WithLogHandler(func(r LogRecord) {
+		fields := log.Fields{}
+		for k, v := range r.Extra {
+			fields[k] = v
+		}
+		fields["logger"] = r.Logger
+		fields["pid"] = r.Pid
+		if r.ExcInfo != "" {
+			fields["exc_info"] = r.ExcInfo
+		}
+		if r.StackInfo != "" {
+			fields["stack_info"] = r.StackInfo
+		}
+		l := logger.WithFields(fields)
+		l.Time = r.Time
+
+		switch {
+		case r.LevelNo >= PythonLogError:
+			l.Error(r.Message)
+		case r.LevelNo >= PythonLogWarning:
+			l.Warning(r.Message)
+		case r.LevelNo >= PythonLogInfo:
+			l.Info(r.Message)
+		case r.LevelNo >= PythonLogDebug:
+			l.Debug(r.Message)
+		default:
+			l.Trace(r.Message)
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package python
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestLogHandler(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("log records are not forwarded on windows")
+	}
+
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	var mutex sync.Mutex
+	var records []LogRecord
+	p := ep.With(WithLogHandler(func(r LogRecord) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		records = append(records, r)
+	}))
+
+	script := `
+import logging, warnings
+logging.basicConfig(level=logging.DEBUG, format="stderr: %(message)s")
+l = logging.getLogger("my.logger")
+l.debug("debug %d", 1)
+l.warning("warn", extra={"key": "value", "obj": object()})
+try:
+    raise ValueError("boom")
+except ValueError:
+    l.exception("failed")
+warnings.warn("careful")
+`
+	res, err := p.Run(context.Background(), RunSpec{Code: script})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res.Stderr), "stderr: debug 1")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !assert.Len(t, records, 4) {
+		return
+	}
+
+	assert.Equal(t, "DEBUG", records[0].Level)
+	assert.Equal(t, PythonLogDebug, records[0].LevelNo)
+	assert.Equal(t, "my.logger", records[0].Logger)
+	assert.Equal(t, "debug 1", records[0].Message)
+	assert.False(t, records[0].Time.IsZero())
+	assert.NotZero(t, records[0].Pid)
+
+	assert.Equal(t, PythonLogWarning, records[1].LevelNo)
+	assert.Equal(t, "value", records[1].Extra["key"])
+	assert.Contains(t, records[1].Extra["obj"], "<object object at")
+
+	assert.Equal(t, PythonLogError, records[2].LevelNo)
+	assert.Contains(t, records[2].ExcInfo, "ValueError: boom")
+
+	assert.Equal(t, "py.warnings", records[3].Logger)
+	assert.Contains(t, records[3].Message, "UserWarning: careful")
+}
+
+func TestLogrusLogging(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("log records are not forwarded on windows")
+	}
+
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.TraceLevel)
+	p := ep.With(WithLogrusLogging(logger))
+
+	script := `
+import logging
+logging.getLogger().setLevel(5)
+l = logging.getLogger("lib")
+l.log(5, "trace")
+l.info("info", extra={"n": 1})
+l.critical("critical")
+`
+	cmd, err := p.Command(context.Background(), "-c", script)
+	assert.NoError(t, err)
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err)
+	assert.Empty(t, string(out))
+
+	// Wait returns only after all events were handled
+	entries := hook.AllEntries()
+	if !assert.Len(t, entries, 3) {
+		return
+	}
+	assert.Equal(t, logrus.TraceLevel, entries[0].Level)
+	assert.Equal(t, logrus.InfoLevel, entries[1].Level)
+	assert.Equal(t, "info", entries[1].Message)
+	assert.Equal(t, "lib", entries[1].Data["logger"])
+	assert.Equal(t, float64(1), entries[1].Data["n"])
+	assert.Equal(t, logrus.ErrorLevel, entries[2].Level)
+}
+
+func TestLogHandlerCommandNotStarted(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("open file descriptors are counted via /proc")
+	}
+
+	p := NewPython(WithLogHandler(func(r LogRecord) {}))
+
+	countFds := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		assert.NoError(t, err)
+		return len(entries)
+	}
+	goroutines := runtime.NumGoroutine()
+	fds := countFds()
+
+	for i := 0; i < 10; i++ {
+		_, err := p.Command(context.Background(), "-c", "import logging; logging.warning('x')")
+		assert.NoError(t, err)
+		_, err = p.PythonCmd("-c", "pass")
+		assert.NoError(t, err)
+	}
+
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+	assert.LessOrEqual(t, countFds(), fds)
+}
+
+func TestLogHandlerCommandStartFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("log records are not forwarded on windows")
+	}
+
+	p := NewPython(WithLogHandler(func(r LogRecord) {}))
+	cmd, err := p.Command(context.Background(), "-c", "pass")
+	assert.NoError(t, err)
+	cmd.Path = filepath.Join(t.TempDir(), "does-not-exist")
+	assert.Error(t, cmd.Run())
+	assert.Empty(t, cmd.ExtraFiles)
+}
@@ -0,0 +1,205 @@
+package python
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Stream identifies the output stream of the interpreter.
+type Stream int
+
+const (
+	StreamStdout Stream = iota
+	StreamStderr
+)
+
+func (s Stream) String() string {
+	switch s {
+	case StreamStdout:
+		return "stdout"
+	case StreamStderr:
+		return "stderr"
+	default:
+		return "unknown"
+	}
+}
+
+// OutputHandler is called for every line written to stdout or stderr by the interpreter. The line does not include
+// the line ending and is only valid until the handler returns.
+type OutputHandler func(stream Stream, line []byte)
+
+// maxOutputLineSize is the size after which long lines are split up, so that a single line can't use up all memory
+const maxOutputLineSize = 64 * 1024
+
+// outputContext describes the command an output line belongs to
+type outputContext struct {
+	cmd    *exec.Cmd
+	script string
+}
+
+func (c *outputContext) pid() int {
+	if c.cmd.Process == nil {
+		return 0
+	}
+	return c.cmd.Process.Pid
+}
+
+type outputHandler func(c *outputContext, stream Stream, line []byte)
+
+// WithOutputHandler streams the output of the interpreter line by line to the given handler while it is running.
+// Lines longer than 64KiB are split up. The handler is never called concurrently for the same command.
+//
+// For commands returned by PythonCmd and friends, the handler is installed as cmd.Stdout and cmd.Stderr. Replacing
+// these disables the handler for the corresponding stream, and they must be set to nil before using cmd.StdoutPipe or
+// cmd.StderrPipe. Run and Worker take care of this themselves.
+func WithOutputHandler(h OutputHandler) PythonOpt {
+	return func(o *python) {
+		o.outputHandlers = append(o.outputHandlers, func(c *outputContext, stream Stream, line []byte) {
+			h(stream, line)
+		})
+	}
+}
+
+// WithLogrusOutput forwards all lines written to stderr by the interpreter to the given logger, which is the place
+// where Python writes warnings, log messages and tracebacks to by default. The entries have the fields "pid" and
+// "script". See WithOutputHandler for details.
+func WithLogrusOutput(logger log.FieldLogger) PythonOpt {
+	return func(o *python) {
+		o.outputHandlers = append(o.outputHandlers, func(c *outputContext, stream Stream, line []byte) {
+			if stream != StreamStderr {
+				return
+			}
+			logger.WithField("pid", c.pid()).WithField("script", c.script).Info(string(line))
+		})
+	}
+}
+
+// scriptName returns a short name of the program that is executed by the given interpreter arguments
+func scriptName(args []string) string {
+	_, program := splitInterpreterArgs(args)
+	switch {
+	case len(program) == 0 || program[0] == "-":
+		return "<stdin>"
+	case program[0] == "-c":
+		return "<string>"
+	case program[0] == "-m" && len(program) > 1:
+		return program[1]
+	default:
+		return filepath.Base(program[0])
+	}
+}
+
+// setupOutputHandlers installs line writers as stdout and stderr of the given command. args are the interpreter
+// arguments before they were rewritten for the launcher.
+func setupOutputHandlers(cmd *exec.Cmd, args []string, handlers []outputHandler) {
+	c := &outputContext{
+		cmd:    cmd,
+		script: scriptName(args),
+	}
+	mutex := &sync.Mutex{}
+	handle := func(stream Stream, line []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, h := range handlers {
+			h(c, stream, line)
+		}
+	}
+	cmd.Stdout = &lineWriter{stream: StreamStdout, handle: handle}
+	cmd.Stderr = &lineWriter{stream: StreamStderr, handle: handle}
+}
+
+// redirectOutput sets w as the destination for the given stream of cmd. If an output handler is installed for the
+// stream, w receives a copy of the output instead.
+func redirectOutput(cmd *exec.Cmd, stream Stream, w io.Writer) {
+	dst := &cmd.Stdout
+	if stream == StreamStderr {
+		dst = &cmd.Stderr
+	}
+	if lw, ok := (*dst).(*lineWriter); ok {
+		lw.tee = w
+	} else {
+		*dst = w
+	}
+}
+
+// lineWriter splits everything written to it into lines and passes them to the handler. It implements io.ReaderFrom,
+// which is used by os/exec to copy the output of the process, so that a trailing partial line can be flushed when
+// the process closes its end of the pipe.
+type lineWriter struct {
+	stream Stream
+	handle func(stream Stream, line []byte)
+	tee    io.Writer
+
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	if w.tee != nil {
+		_, err := w.tee.Write(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	w.buf = append(w.buf, p...)
+	rest := w.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i == -1 {
+			break
+		}
+		w.emit(bytes.TrimSuffix(rest[:i], []byte{'\r'}))
+		rest = rest[i+1:]
+	}
+	for len(rest) >= maxOutputLineSize {
+		w.emit(rest[:maxOutputLineSize])
+		rest = rest[maxOutputLineSize:]
+	}
+	// keep the partial line at the beginning of the buffer
+	w.buf = append(w.buf[:0], rest...)
+	return len(p), nil
+}
+
+func (w *lineWriter) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var n int64
+	for {
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			n += int64(nr)
+			_, werr := w.Write(buf[:nr])
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if err != nil {
+			w.flush()
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, err
+		}
+	}
+}
+
+func (w *lineWriter) flush() {
+	if len(w.buf) != 0 {
+		w.emit(bytes.TrimSuffix(w.buf, []byte{'\r'}))
+		w.buf = nil
+	}
+}
+
+// emit passes the given line to the handler, split up into chunks of maxOutputLineSize
+func (w *lineWriter) emit(line []byte) {
+	for len(line) > maxOutputLineSize {
+		w.handle(w.stream, line[:maxOutputLineSize])
+		line = line[maxOutputLineSize:]
+	}
+	w.handle(w.stream, line)
+}
@@ -0,0 +1,92 @@
+package python
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := &lineWriter{stream: StreamStderr, handle: func(stream Stream, line []byte) {
+		assert.Equal(t, StreamStderr, stream)
+		lines = append(lines, string(line))
+	}}
+
+	longLine := strings.Repeat("x", maxOutputLineSize+10)
+	_, err := w.ReadFrom(strings.NewReader("a\nb\r\n\npartial"))
+	assert.NoError(t, err)
+	_, _ = w.Write([]byte("c"))
+	_, _ = w.Write([]byte("d\n" + longLine + "\n"))
+
+	assert.Equal(t, []string{"a", "b", "", "partial", "cd"}, lines[:5])
+	assert.Len(t, lines, 7)
+	assert.Equal(t, longLine, lines[5]+lines[6])
+	assert.Len(t, lines[5], maxOutputLineSize)
+}
+
+func TestOutputHandler(t *testing.T) {
+	var mutex sync.Mutex
+	lines := map[Stream][]string{}
+	ep := NewPython(WithOutputHandler(func(stream Stream, line []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		lines[stream] = append(lines[stream], string(line))
+	}))
+
+	// more output than fits into a pipe buffer, without a trailing newline
+	script := `
+import sys
+for i in range(20000):
+    print("line %d" % i)
+    print("err %d" % i, file=sys.stderr)
+sys.stdout.write("partial")
+`
+	res, err := ep.Run(context.Background(), RunSpec{Code: script})
+	assert.NoError(t, err)
+
+	assert.Len(t, lines[StreamStdout], 20001)
+	assert.Len(t, lines[StreamStderr], 20000)
+	assert.Equal(t, "line 19999", lines[StreamStdout][19999])
+	assert.Equal(t, "partial", lines[StreamStdout][20000])
+	assert.Equal(t, "err 0", lines[StreamStderr][0])
+	// Run still captures the output
+	assert.True(t, strings.HasSuffix(string(res.Stdout), "line 19999\npartial"))
+
+	cmd, err := ep.PythonCmd("-c", "print('from cmd')")
+	assert.NoError(t, err)
+	assert.NoError(t, cmd.Run())
+	assert.Equal(t, "from cmd", lines[StreamStdout][len(lines[StreamStdout])-1])
+}
+
+func TestLogrusOutput(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	ep := NewPython(WithLogrusOutput(logger))
+
+	res, err := ep.Run(context.Background(), RunSpec{
+		Code: "import sys; print('ignored'); print('to log', file=sys.stderr)",
+	})
+	assert.NoError(t, err)
+
+	entries := hook.AllEntries()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "to log", entries[0].Message)
+	assert.Equal(t, logrus.InfoLevel, entries[0].Level)
+	assert.Equal(t, "<string>", entries[0].Data["script"])
+	assert.NotZero(t, entries[0].Data["pid"])
+	assert.Equal(t, "ignored\n", string(res.Stdout))
+
+	w, err := NewWorker(NewPython(WithLogrusOutput(logger)))
+	assert.NoError(t, err)
+	defer w.Close()
+	err = w.Call(context.Background(), "builtins", "print", []any{"from worker"}, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, "from worker", hook.LastEntry().Message)
+	assert.Equal(t, fmt.Sprint(w.Pid()), fmt.Sprint(hook.LastEntry().Data["pid"]))
+}
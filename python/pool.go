@@ -0,0 +1,284 @@
+package python
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrPoolClosed is returned when calling into a Pool that has been closed.
+	ErrPoolClosed = errors.New("python pool is closed")
+	// ErrPoolQueueFull is returned when the number of callers waiting for a worker exceeds the configured limit.
+	ErrPoolQueueFull = errors.New("python pool queue is full")
+)
+
+const (
+	DefaultPoolHealthCheckInterval = 30 * time.Second
+	poolHealthCheckTimeout         = 10 * time.Second
+)
+
+// Pool keeps a fixed number of Worker instances warm and hands them out to concurrent callers. Workers are
+// transparently replaced when they crash, fail a health check, exceed the configured RSS limit or have served the
+// configured number of calls.
+type Pool struct {
+	p                   Python
+	size                int
+	maxQueue            int
+	maxCalls            int
+	maxRSS              int64
+	healthCheckInterval time.Duration
+	workerOpts          []WorkerOpt
+
+	// idle holds exactly one entry per slot that is not in use. A nil entry means that the slot has no running
+	// worker and that one must be started on acquire.
+	idle    chan *Worker
+	waiting int32
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	wg        sync.WaitGroup
+}
+
+type PoolOpt func(p *Pool)
+
+// WithPoolSize sets the number of workers kept by the pool. Defaults to runtime.NumCPU().
+func WithPoolSize(n int) PoolOpt {
+	return func(p *Pool) {
+		p.size = n
+	}
+}
+
+// WithPoolMaxQueue limits the number of callers that may wait for a worker at the same time. Further callers fail
+// with ErrPoolQueueFull. Defaults to 0, which means unlimited.
+func WithPoolMaxQueue(n int) PoolOpt {
+	return func(p *Pool) {
+		p.maxQueue = n
+	}
+}
+
+// WithPoolMaxCalls causes workers to be replaced after they have served the given number of calls.
+func WithPoolMaxCalls(n int) PoolOpt {
+	return func(p *Pool) {
+		p.maxCalls = n
+	}
+}
+
+// WithPoolMaxRSS causes workers to be replaced when their resident set size exceeds the given number of bytes. The
+// RSS is checked after every call and as part of the periodic health checks.
+func WithPoolMaxRSS(bytes int64) PoolOpt {
+	return func(p *Pool) {
+		p.maxRSS = bytes
+	}
+}
+
+// WithPoolHealthCheckInterval sets the interval at which idle workers are health checked. A value of 0 disables
+// health checks.
+func WithPoolHealthCheckInterval(d time.Duration) PoolOpt {
+	return func(p *Pool) {
+		p.healthCheckInterval = d
+	}
+}
+
+// WithPoolWorkerOpts sets the options passed to NewWorker when starting workers.
+func WithPoolWorkerOpts(opts ...WorkerOpt) PoolOpt {
+	return func(p *Pool) {
+		p.workerOpts = opts
+	}
+}
+
+// NewPool creates a new pool and starts all of its workers. The pool must be closed via Close when it is not needed
+// anymore.
+func NewPool(python Python, opts ...PoolOpt) (*Pool, error) {
+	p := &Pool{
+		p:                   python,
+		size:                runtime.NumCPU(),
+		healthCheckInterval: DefaultPoolHealthCheckInterval,
+		closing:             make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	if p.size <= 0 {
+		p.size = 1
+	}
+
+	p.idle = make(chan *Worker, p.size)
+	for i := 0; i < p.size; i++ {
+		w, err := NewWorker(p.p, p.workerOpts...)
+		if err != nil {
+			for ; i < p.size; i++ {
+				p.idle <- nil
+			}
+			_ = p.Close()
+			return nil, err
+		}
+		p.idle <- w
+	}
+
+	if p.healthCheckInterval > 0 {
+		p.wg.Add(1)
+		go p.healthCheckLoop()
+	}
+
+	return p, nil
+}
+
+// Call acquires a worker, performs the call via Worker.Call and then releases the worker back into the pool. See
+// Worker.Call for details.
+func (p *Pool) Call(ctx context.Context, module string, function string, args any, result any) error {
+	w, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.release(w)
+	return w.Call(ctx, module, function, args, result)
+}
+
+func (p *Pool) acquire(ctx context.Context) (*Worker, error) {
+	select {
+	case <-p.closing:
+		return nil, ErrPoolClosed
+	default:
+	}
+
+	var w *Worker
+	select {
+	case w = <-p.idle:
+	default:
+		if p.maxQueue > 0 {
+			if atomic.AddInt32(&p.waiting, 1) > int32(p.maxQueue) {
+				atomic.AddInt32(&p.waiting, -1)
+				return nil, ErrPoolQueueFull
+			}
+			defer atomic.AddInt32(&p.waiting, -1)
+		}
+		select {
+		case w = <-p.idle:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-p.closing:
+			return nil, ErrPoolClosed
+		}
+	}
+
+	if w != nil && !w.isClosed() {
+		return w, nil
+	}
+
+	// the slot has no usable worker, so we start one on behalf of the caller
+	if w != nil {
+		_ = w.Close()
+	}
+	w, err := NewWorker(p.p, p.workerOpts...)
+	if err != nil {
+		p.idle <- nil
+		return nil, err
+	}
+	return w, nil
+}
+
+func (p *Pool) release(w *Worker) {
+	if w.isClosed() || (p.maxCalls > 0 && w.Calls() >= p.maxCalls) || (p.maxRSS > 0 && !p.healthy(w)) {
+		p.replace(w)
+		return
+	}
+	p.idle <- w
+}
+
+// healthy queries the stats of the worker and checks them against the configured RSS limit
+func (p *Pool) healthy(w *Worker) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), poolHealthCheckTimeout)
+	defer cancel()
+	st, err := w.Stats(ctx)
+	if err != nil {
+		return false
+	}
+	return p.maxRSS <= 0 || st.RSS <= p.maxRSS
+}
+
+// replace closes the given worker and starts a new one in the background, which is then put back into the slot.
+func (p *Pool) replace(w *Worker) {
+	if w != nil {
+		_ = w.Close()
+	}
+	go func() {
+		select {
+		case <-p.closing:
+			p.idle <- nil
+			return
+		default:
+		}
+		nw, err := NewWorker(p.p, p.workerOpts...)
+		if err != nil {
+			// will be retried on next acquire
+			nw = nil
+		}
+		p.idle <- nw
+	}()
+}
+
+func (p *Pool) healthCheckLoop() {
+	defer p.wg.Done()
+
+	t := time.NewTicker(p.healthCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.closing:
+			return
+		case <-t.C:
+			p.checkIdleWorkers()
+		}
+	}
+}
+
+func (p *Pool) checkIdleWorkers() {
+	for i := 0; i < p.size; i++ {
+		var w *Worker
+		select {
+		case w = <-p.idle:
+		default:
+			return
+		}
+
+		if w == nil {
+			// try to warm up slots that lost their worker
+			p.replace(nil)
+			continue
+		}
+
+		if !p.healthy(w) {
+			p.replace(w)
+			continue
+		}
+		p.idle <- w
+	}
+}
+
+// Close stops all workers. It waits for calls that are currently in progress to finish.
+func (p *Pool) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		p.wg.Wait()
+
+		var errs []error
+		for i := 0; i < p.size; i++ {
+			w := <-p.idle
+			if w == nil {
+				continue
+			}
+			err := w.Close()
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		p.closeErr = errors.Join(errs...)
+	})
+	return p.closeErr
+}
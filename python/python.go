@@ -1,25 +1,96 @@
 package python
 
 import (
+	"context"
 	"fmt"
+	"github.com/kluctl/go-embed-python/embed_util"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
+// DefaultGracePeriod is the time given to a Python process to handle the SIGINT sent on context cancellation before
+// its whole process group is killed.
+const DefaultGracePeriod = 5 * time.Second
+
 type Python interface {
 	GetExeName() string
 	GetExePath() (string, error)
 	AddPythonPath(p string)
+
+	// PythonCmd, PythonCmd2 and PythonCmdContext return plain commands. These don't forward log records and audit
+	// events to Go (see WithLogHandler and WithAuditPolicy) and don't hold a usage lock on the extracted files of an
+	// EmbeddedPython, use Command for that.
 	PythonCmd(args ...string) (*exec.Cmd, error)
 	PythonCmd2(args []string) (*exec.Cmd, error)
+
+	// PythonCmdContext is like PythonCmd, but the returned command is bound to the given context. When the context is
+	// done, the process group of the interpreter receives a SIGINT so that KeyboardInterrupt is raised and finally
+	// blocks get a chance to run. When the grace period (see WithGracePeriod) is over, the whole process group is
+	// killed, including all child processes spawned by the interpreter that are still running, even if the interpreter
+	// itself already exited. On Windows, the interpreter is killed immediately.
+	PythonCmdContext(ctx context.Context, args ...string) (*exec.Cmd, error)
+
+	// Command is like PythonCmdContext, but returns a Cmd, which forwards log records and audit events to Go while
+	// the interpreter is running.
+	Command(ctx context.Context, args ...string) (*Cmd, error)
+
+	// Run executes the interpreter as described by spec, waits for it to finish and returns the captured output and
+	// resource usage. If the interpreter exits with a non-zero exit code, both the result and an error are returned.
+	// If the interpreter exited due to an uncaught exception, the error is a *PythonError.
+	Run(ctx context.Context, spec RunSpec) (*RunResult, error)
+
+	// Version starts the interpreter and queries its sys.version_info. For the embedded distribution, see also
+	// EmbeddedVersion, which does not require starting the interpreter.
+	Version(ctx context.Context) (*VersionInfo, error)
+
+	// With returns a shallow copy of this Python with the given options applied on top of the existing ones. The
+	// Python path and environment are copied, so later calls to AddPythonPath on one of them don't affect the other.
+	// Handlers, Sandbox and AuditPolicy are shared. For an *EmbeddedPython, the copy is an *EmbeddedPython as well,
+	// see EmbeddedPython.Derive.
+	With(opts ...PythonOpt) Python
 }
 
 type python struct {
-	pythonHome string
+	pythonHome  string
+	venvPath    string
+	gracePeriod time.Duration
+
+	// mutex protects pythonPath and lazyPaths, which can be modified after construction
+	mutex      sync.Mutex
 	pythonPath []string
+	lazyPaths  []*lazyPythonPath
+
+	// usageDirs are extraction directories used by the interpreter, see Cmd.Start
+	usageDirs []string
+
+	env               []string
+	argsPrefix        []string
+	unbuffered        bool
+	dontWriteBytecode bool
+	utf8Mode          bool
+	devMode           bool
+	workDir           string
+	ioEncoding        string
+	pycachePrefix     string
+
+	isolated     bool
+	envAllowlist []string
+
+	sandbox     *Sandbox
+	auditPolicy *AuditPolicy
+
+	outputHandlers []outputHandler
+	logHandlers    []func(r LogRecord)
+
+	systemFallback bool
+	autoGC         bool
+	verifyMode     embed_util.VerifyMode
 }
 
 type PythonOpt func(o *python)
@@ -30,8 +101,129 @@ func WithPythonHome(home string) PythonOpt {
 	}
 }
 
+// WithVenv configures the interpreter of the virtual environment found at the given path to be used. PYTHONHOME is
+// not set in that case, as the venv interpreter figures out its home via pyvenv.cfg.
+func WithVenv(venvPath string) PythonOpt {
+	return func(o *python) {
+		o.venvPath = venvPath
+	}
+}
+
+// WithGracePeriod sets the time a Python process is given to exit after it has been interrupted due to context
+// cancellation. See PythonCmdContext for details.
+func WithGracePeriod(d time.Duration) PythonOpt {
+	return func(o *python) {
+		o.gracePeriod = d
+	}
+}
+
+// WithIsolatedEnv causes the interpreter to be started in isolated mode, which protects it from being influenced by
+// the environment of the host. This is similar to Python's own -I flag, which can't be used directly as it would
+// also ignore PYTHONHOME and PYTHONPATH. In isolated mode, all PYTHON* variables and variables that point to
+// virtual environments are removed from the inherited environment, and the user site-packages directory is not
+// added to sys.path (see the -s flag).
+//
+// If allowlist is non-empty, only the listed variables are inherited, including PYTHON* variables.
+func WithIsolatedEnv(allowlist ...string) PythonOpt {
+	return func(o *python) {
+		o.isolated = true
+		o.envAllowlist = allowlist
+	}
+}
+
+// WithPythonPath adds the given paths to the Python path. See also AddPythonPath.
+func WithPythonPath(paths ...string) PythonOpt {
+	return func(o *python) {
+		for _, p := range paths {
+			o.addPythonPath(p)
+		}
+	}
+}
+
+// WithEnv adds environment variables in the form KEY=value. These take precedence over the inherited environment,
+// but not over the variables managed by other options, e.g. PYTHONHOME and PYTHONPATH.
+func WithEnv(env ...string) PythonOpt {
+	return func(o *python) {
+		o.env = append(o.env, env...)
+	}
+}
+
+// WithArgsPrefix adds arguments that are passed to the interpreter before all other arguments, e.g.
+// []string{"-W", "error"}.
+func WithArgsPrefix(args ...string) PythonOpt {
+	return func(o *python) {
+		o.argsPrefix = append(o.argsPrefix, args...)
+	}
+}
+
+// WithUnbuffered forces stdout and stderr to be unbuffered (see the -u flag).
+func WithUnbuffered(unbuffered bool) PythonOpt {
+	return func(o *python) {
+		o.unbuffered = unbuffered
+	}
+}
+
+// WithDontWriteBytecode prevents the interpreter from writing .pyc files (see the -B flag).
+func WithDontWriteBytecode(dontWrite bool) PythonOpt {
+	return func(o *python) {
+		o.dontWriteBytecode = dontWrite
+	}
+}
+
+// WithUTF8Mode enables the Python UTF-8 mode (see -X utf8).
+func WithUTF8Mode(utf8Mode bool) PythonOpt {
+	return func(o *python) {
+		o.utf8Mode = utf8Mode
+	}
+}
+
+// WithDevMode enables the Python development mode (see -X dev).
+func WithDevMode(devMode bool) PythonOpt {
+	return func(o *python) {
+		o.devMode = devMode
+	}
+}
+
+// WithWorkDir sets the working directory of the interpreter. By default, the working directory of the current
+// process is used.
+func WithWorkDir(dir string) PythonOpt {
+	return func(o *python) {
+		o.workDir = dir
+	}
+}
+
+// WithIOEncoding sets the encoding used for stdin, stdout and stderr via PYTHONIOENCODING, e.g. "utf-8" or
+// "utf-8:replace".
+func WithIOEncoding(encoding string) PythonOpt {
+	return func(o *python) {
+		o.ioEncoding = encoding
+	}
+}
+
+// WithPycachePrefix causes the interpreter to read and write .pyc files in a parallel directory tree at the given
+// path instead of in __pycache__ directories next to the sources (see PYTHONPYCACHEPREFIX). This allows bytecode to be
+// cached across runs when the sources are on a read-only file system or are extracted to a new directory for every
+// process. Please note that .pyc files found in __pycache__ directories, e.g. those precompiled via
+// embed_util.WithCompileBytecode, are ignored in that case. See UserPycachePrefix for a sensible default.
+func WithPycachePrefix(dir string) PythonOpt {
+	return func(o *python) {
+		o.pycachePrefix = dir
+	}
+}
+
+// UserPycachePrefix returns a per-user directory that can be passed to WithPycachePrefix.
+func UserPycachePrefix() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine user cache dir: %w", err)
+	}
+	return filepath.Join(dir, "go-embed-python", "pycache"), nil
+}
+
 func NewPython(opts ...PythonOpt) Python {
-	ep := &python{}
+	ep := &python{
+		gracePeriod: DefaultGracePeriod,
+	}
 
 	for _, o := range opts {
 		o(ep)
@@ -51,7 +243,18 @@ func (ep *python) GetExeName() string {
 }
 
 func (ep *python) GetExePath() (string, error) {
-	if ep.pythonHome == "" {
+	if ep.venvPath != "" {
+		var p string
+		if runtime.GOOS == "windows" {
+			p = filepath.Join(ep.venvPath, "Scripts", ep.GetExeName())
+		} else {
+			p = filepath.Join(ep.venvPath, "bin", ep.GetExeName())
+		}
+		if _, err := os.Stat(p); err != nil {
+			return "", fmt.Errorf("failed to determine %s path: %w", ep.GetExeName(), err)
+		}
+		return p, nil
+	} else if ep.pythonHome == "" {
 		p, err := exec.LookPath(ep.GetExeName())
 		if err != nil {
 			return "", fmt.Errorf("failed to determine %s path: %w", ep.GetExeName(), err)
@@ -71,31 +274,337 @@ func (ep *python) GetExePath() (string, error) {
 	}
 }
 
+func (ep *python) With(opts ...PythonOpt) Python {
+	ep.mutex.Lock()
+	n := &python{
+		pythonHome:        ep.pythonHome,
+		venvPath:          ep.venvPath,
+		gracePeriod:       ep.gracePeriod,
+		pythonPath:        append([]string{}, ep.pythonPath...),
+		lazyPaths:         append([]*lazyPythonPath{}, ep.lazyPaths...),
+		usageDirs:         append([]string{}, ep.usageDirs...),
+		env:               append([]string{}, ep.env...),
+		argsPrefix:        append([]string{}, ep.argsPrefix...),
+		unbuffered:        ep.unbuffered,
+		dontWriteBytecode: ep.dontWriteBytecode,
+		utf8Mode:          ep.utf8Mode,
+		devMode:           ep.devMode,
+		workDir:           ep.workDir,
+		ioEncoding:        ep.ioEncoding,
+		pycachePrefix:     ep.pycachePrefix,
+		isolated:          ep.isolated,
+		envAllowlist:      append([]string{}, ep.envAllowlist...),
+		systemFallback:    ep.systemFallback,
+		autoGC:            ep.autoGC,
+		verifyMode:        ep.verifyMode,
+		sandbox:           ep.sandbox,
+		auditPolicy:       ep.auditPolicy,
+		outputHandlers:    append([]outputHandler{}, ep.outputHandlers...),
+		logHandlers:       append([]func(r LogRecord){}, ep.logHandlers...),
+	}
+	ep.mutex.Unlock()
+
+	for _, o := range opts {
+		o(n)
+	}
+	return n
+}
+
 func (ep *python) AddPythonPath(p string) {
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	ep.addPythonPath(p)
+}
+
+func (ep *python) addPythonPath(p string) {
 	ep.pythonPath = append(ep.pythonPath, p)
 }
 
+// lazyPythonPath is a list of Python paths that is only resolved when the first command is created. Failed
+// resolutions are retried with the next command. Besides the paths, resolve returns the extraction directories that
+// contain them.
+type lazyPythonPath struct {
+	mutex     sync.Mutex
+	resolve   func() ([]string, []string, error)
+	resolved  bool
+	paths     []string
+	usageDirs []string
+}
+
+func (lp *lazyPythonPath) get() ([]string, []string, error) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	if !lp.resolved {
+		p, usageDirs, err := lp.resolve()
+		if err != nil {
+			return nil, nil, err
+		}
+		lp.paths = p
+		lp.usageDirs = usageDirs
+		lp.resolved = true
+	}
+	return lp.paths, lp.usageDirs, nil
+}
+
+func (ep *python) addLazyPythonPath(resolve func() ([]string, []string, error)) {
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	ep.lazyPaths = append(ep.lazyPaths, &lazyPythonPath{resolve: resolve})
+}
+
 func (ep *python) PythonCmd(args ...string) (*exec.Cmd, error) {
 	return ep.PythonCmd2(args)
 }
 
 func (ep *python) PythonCmd2(args []string) (*exec.Cmd, error) {
+	c, err := ep.pythonCmd(nil, args)
+	if err != nil {
+		return nil, err
+	}
+	return c.Cmd, nil
+}
+
+func (ep *python) PythonCmdContext(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	c, err := ep.Command(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return c.Cmd, nil
+}
+
+func (ep *python) Command(ctx context.Context, args ...string) (*Cmd, error) {
+	if ctx == nil {
+		return nil, fmt.Errorf("nil Context")
+	}
+	return ep.pythonCmd(ctx, args)
+}
+
+// pythonCmd creates the interpreter command. If ctx is nil, the command is not bound to a context.
+func (ep *python) pythonCmd(ctx context.Context, args []string) (*Cmd, error) {
 	exePath, err := ep.GetExePath()
 	if err != nil {
 		return nil, err
 	}
 
-	cmd := exec.Command(exePath, args...)
-	cmd.Env = os.Environ()
+	pythonPath, usageDirs, err := ep.resolvePythonPath()
+	if err != nil {
+		return nil, err
+	}
+
+	args = append(ep.interpreterArgs(), args...)
+
+	var cmd *exec.Cmd
+	if ctx == nil {
+		cmd = exec.Command(exePath, args...)
+	} else {
+		cmd = exec.CommandContext(ctx, exePath, args...)
+		setupGracefulCancel(cmd, ep.gracePeriod)
+	}
+	cmd.Dir = ep.workDir
+	cmd.Env = ep.buildEnv(pythonPath)
+	if len(ep.outputHandlers) != 0 {
+		setupOutputHandlers(cmd, args, ep.outputHandlers)
+	}
+
+	c := &Cmd{Cmd: cmd, usageDirs: usageDirs}
+	if ep.sandbox == nil && ep.auditPolicy == nil && len(ep.logHandlers) == 0 {
+		return c, nil
+	}
+
+	launcherCfg := launcherConfig{}
+	if ep.sandbox != nil {
+		err = setupSandbox(cmd, ep.sandbox)
+		if err != nil {
+			return nil, err
+		}
+		if ep.sandbox.IsolateMounts {
+			cmd.Env = mergeEnv(cmd.Env, fmt.Sprintf("TMPDIR=%s", ep.sandbox.scratchDir()))
+		}
+		launcherCfg.Sandbox = ep.sandbox.buildConfig(ep.sandboxReadOnlyPaths(pythonPath))
+	}
+	if ep.auditPolicy != nil {
+		launcherCfg.Audit = ep.auditPolicy.buildConfig()
+	}
+	// ExtraFiles is not supported on Windows, so no events are reported there
+	if (ep.auditPolicy != nil || len(ep.logHandlers) != 0) && runtime.GOOS != "windows" {
+		launcherCfg.Logging = len(ep.logHandlers) != 0
+		c.handle = ep.handleLauncherEvent
+	}
+
+	// the event pipe is only added by Cmd.Start, so commands started via the embedded exec.Cmd don't report events
+	cmdArgs, err := launcherArgs(args, launcherCfg)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Args = append(cmd.Args[:1], cmdArgs...)
+	c.args = args
+	c.launcherCfg = launcherCfg
+
+	return c, nil
+}
 
+func (ep *python) handleLauncherEvent(e *launcherEvent) {
+	switch {
+	case e.Type == "audit" && e.Audit != nil && ep.auditPolicy != nil:
+		ep.auditPolicy.handleEvent(*e.Audit)
+	case e.Type == "log" && e.Log != nil:
+		for _, h := range ep.logHandlers {
+			h(*e.Log)
+		}
+	}
+}
+
+// sandboxReadOnlyPaths returns the paths used by the interpreter itself, which must be protected by the sandbox
+func (ep *python) sandboxReadOnlyPaths(pythonPath []string) []string {
+	var ret []string
+	for _, p := range append([]string{ep.pythonHome, ep.venvPath}, pythonPath...) {
+		if p == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(p); err == nil {
+			ret = append(ret, abs)
+		}
+	}
+	return ret
+}
+
+// interpreterArgs returns the arguments that are passed to the interpreter in front of the caller's arguments
+func (ep *python) interpreterArgs() []string {
+	var args []string
+	if ep.isolated {
+		args = append(args, "-s")
+	}
+	if ep.unbuffered {
+		args = append(args, "-u")
+	}
+	if ep.dontWriteBytecode {
+		args = append(args, "-B")
+	}
+	if ep.utf8Mode {
+		args = append(args, "-X", "utf8")
+	}
+	if ep.devMode {
+		args = append(args, "-X", "dev")
+	}
+	return append(args, ep.argsPrefix...)
+}
+
+// resolvePythonPath returns all Python path entries, including the lazy ones, and the extraction directories used by
+// the interpreter
+func (ep *python) resolvePythonPath() ([]string, []string, error) {
+	ep.mutex.Lock()
+	pythonPath := append([]string{}, ep.pythonPath...)
+	lazyPaths := append([]*lazyPythonPath{}, ep.lazyPaths...)
+	ep.mutex.Unlock()
+
+	usageDirs := append([]string{}, ep.usageDirs...)
+	for _, lp := range lazyPaths {
+		p, d, err := lp.get()
+		if err != nil {
+			return nil, nil, err
+		}
+		pythonPath = append(pythonPath, p...)
+		usageDirs = append(usageDirs, d...)
+	}
+	return pythonPath, usageDirs, nil
+}
+
+func (ep *python) buildEnv(pythonPath []string) []string {
+	env := os.Environ()
+	if ep.isolated {
+		env = filterIsolatedEnv(env, ep.envAllowlist)
+	}
+
+	overrides := append([]string{}, ep.env...)
+	if ep.ioEncoding != "" {
+		overrides = append(overrides, fmt.Sprintf("PYTHONIOENCODING=%s", ep.ioEncoding))
+	}
+	if ep.pycachePrefix != "" {
+		overrides = append(overrides, fmt.Sprintf("PYTHONPYCACHEPREFIX=%s", ep.pycachePrefix))
+	}
 	if ep.pythonHome != "" {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("PYTHONHOME=%s", ep.pythonHome))
+		overrides = append(overrides, fmt.Sprintf("PYTHONHOME=%s", ep.pythonHome))
+	}
+	if len(pythonPath) != 0 {
+		overrides = append(overrides, fmt.Sprintf("PYTHONPATH=%s", strings.Join(pythonPath, string(os.PathListSeparator))))
+	}
+	if ep.isolated {
+		overrides = append(overrides, "PYTHONNOUSERSITE=1")
 	}
 
-	if len(ep.pythonPath) != 0 {
-		pythonPathEnv := fmt.Sprintf("PYTHONPATH=%s", strings.Join(ep.pythonPath, string(os.PathListSeparator)))
-		cmd.Env = append(cmd.Env, pythonPathEnv)
+	return mergeEnv(env, overrides...)
+}
+
+// isolatedEnvBlocklist contains non PYTHON* variables that are removed in isolated mode
+var isolatedEnvBlocklist = []string{
+	"VIRTUAL_ENV",
+	"__PYVENV_LAUNCHER__",
+}
+
+func filterIsolatedEnv(env []string, allowlist []string) []string {
+	allowed := map[string]bool{}
+	for _, k := range allowlist {
+		allowed[envKey(k)] = true
+	}
+
+	var ret []string
+	for _, e := range env {
+		k := envKey(envName(e))
+		if len(allowlist) != 0 {
+			if allowed[k] {
+				ret = append(ret, e)
+			}
+			continue
+		}
+		if strings.HasPrefix(k, "PYTHON") {
+			continue
+		}
+		blocked := false
+		for _, b := range isolatedEnvBlocklist {
+			if k == envKey(b) {
+				blocked = true
+				break
+			}
+		}
+		if !blocked {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// mergeEnv applies the given overrides to env and removes duplicate variables. For duplicates, the last value wins.
+// The result is sorted by variable name, so that it does not depend on the order of the parent environment.
+func mergeEnv(env []string, overrides ...string) []string {
+	m := map[string]string{}
+	for _, e := range append(env, overrides...) {
+		m[envKey(envName(e))] = e
+	}
+
+	ret := make([]string, 0, len(m))
+	for _, e := range m {
+		ret = append(ret, e)
 	}
+	sort.Strings(ret)
+	return ret
+}
 
-	return cmd, nil
+// envName returns the variable name of a KEY=value entry. Names may start with "=" on Windows, e.g. "=C:=C:\\".
+func envName(e string) string {
+	if e == "" {
+		return ""
+	}
+	i := strings.Index(e[1:], "=")
+	if i == -1 {
+		return e
+	}
+	return e[:i+1]
+}
+
+// envKey normalizes the given variable name, as variable names are case-insensitive on Windows
+func envKey(k string) string {
+	if runtime.GOOS == "windows" {
+		return strings.ToUpper(k)
+	}
+	return k
 }
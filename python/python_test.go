@@ -1,13 +1,36 @@
 package python
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/kluctl/go-embed-python/internal"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
+// TestMain isolates all tests from the real cache directory, into which embedded files are extracted by default
+func TestMain(m *testing.M) {
+	restore, err := internal.SetTempCacheDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	restore()
+	os.Exit(code)
+}
+
 func TestExternalPython(t *testing.T) {
 	ep := NewPython()
 
@@ -31,3 +54,272 @@ func TestExternalPython(t *testing.T) {
 	stdoutStr = bytes.TrimSpace(stdoutStr)
 	assert.Equal(t, "test test", string(stdoutStr))
 }
+
+func TestPythonCmdContextCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGINT is not supported on windows")
+	}
+
+	ep := NewPython(WithGracePeriod(2 * time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	script := startChildIgnoringSigint + `
+try:
+    print("started", child.pid, flush=True)
+    time.sleep(60)
+finally:
+    print("cleanup", flush=True)
+`
+	cmd, err := ep.PythonCmdContext(ctx, "-c", script)
+	assert.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	assert.NoError(t, err)
+
+	err = cmd.Start()
+	assert.NoError(t, err)
+
+	s := bufio.NewScanner(stdout)
+	assert.True(t, s.Scan())
+	var childPid int
+	_, err = fmt.Sscanf(s.Text(), "started %d", &childPid)
+	assert.NoError(t, err)
+
+	startTime := time.Now()
+	cancel()
+
+	assert.True(t, s.Scan())
+	assert.Equal(t, "cleanup", s.Text())
+
+	err = cmd.Wait()
+	assert.Error(t, err)
+	assert.Less(t, time.Since(startTime), 2*time.Second)
+
+	// the child outlived the interpreter, but not the grace period
+	assert.Eventually(t, func() bool { return processGone(childPid) }, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestPythonCmdContextGraceKill(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGINT is not supported on windows")
+	}
+
+	ep := NewPython(WithGracePeriod(500 * time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	script := startChildIgnoringSigint + `
+signal.signal(signal.SIGINT, signal.SIG_IGN)
+print("started", child.pid, flush=True)
+time.sleep(60)
+`
+	cmd, err := ep.PythonCmdContext(ctx, "-c", script)
+	assert.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	assert.NoError(t, err)
+
+	err = cmd.Start()
+	assert.NoError(t, err)
+
+	s := bufio.NewScanner(stdout)
+	assert.True(t, s.Scan())
+	var childPid int
+	_, err = fmt.Sscanf(s.Text(), "started %d", &childPid)
+	assert.NoError(t, err)
+
+	startTime := time.Now()
+	cancel()
+
+	err = cmd.Wait()
+	assert.Error(t, err)
+	assert.Less(t, time.Since(startTime), 5*time.Second)
+	assert.Eventually(t, func() bool { return processGone(childPid) }, 5*time.Second, 50*time.Millisecond)
+}
+
+// startChildIgnoringSigint starts a child process that survives the SIGINT sent on context cancellation
+const startChildIgnoringSigint = `
+import signal, subprocess, time
+child = subprocess.Popen(["sleep", "60"], preexec_fn=lambda: signal.signal(signal.SIGINT, signal.SIG_IGN),
+                         stdin=subprocess.DEVNULL, stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL)
+`
+
+// processGone returns true if the process with the given pid has exited. Orphaned zombies that were not reaped yet
+// count as exited.
+func processGone(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err == nil {
+		// the state follows the command name in parentheses
+		fields := bytes.Fields(stat[bytes.LastIndexByte(stat, ')')+1:])
+		return len(fields) > 0 && string(fields[0]) == "Z"
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return true
+	}
+	return errors.Is(p.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+func TestIsolatedEnv(t *testing.T) {
+	t.Setenv("PYTHONSTARTUP", "/does/not/exist")
+	t.Setenv("VIRTUAL_ENV", "/does/not/exist")
+	t.Setenv("GO_EMBED_PYTHON_TEST", "1")
+
+	getEnv := func(p Python) map[string]string {
+		cmd, err := p.PythonCmd("-c", "import os, sys; print('\\n'.join('%s=%s' % (k, v) for k, v in os.environ.items()))")
+		assert.NoError(t, err)
+
+		seen := map[string]bool{}
+		for _, e := range cmd.Env {
+			k := envName(e)
+			assert.False(t, seen[k], "duplicate env %s", k)
+			seen[k] = true
+		}
+
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+		m := map[string]string{}
+		for _, l := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			s := strings.SplitN(l, "=", 2)
+			if len(s) == 2 {
+				m[s[0]] = s[1]
+			}
+		}
+		return m
+	}
+
+	env := getEnv(NewPython())
+	assert.Equal(t, "/does/not/exist", env["PYTHONSTARTUP"])
+	assert.Equal(t, "1", env["GO_EMBED_PYTHON_TEST"])
+
+	env = getEnv(NewPython(WithIsolatedEnv()))
+	assert.NotContains(t, env, "PYTHONSTARTUP")
+	assert.NotContains(t, env, "VIRTUAL_ENV")
+	assert.Equal(t, "1", env["GO_EMBED_PYTHON_TEST"])
+	assert.Equal(t, "1", env["PYTHONNOUSERSITE"])
+
+	env = getEnv(NewPython(WithIsolatedEnv("PATH", "PYTHONSTARTUP")))
+	assert.Equal(t, "/does/not/exist", env["PYTHONSTARTUP"])
+	assert.NotContains(t, env, "GO_EMBED_PYTHON_TEST")
+}
+
+func TestRun(t *testing.T) {
+	ep := NewPython()
+
+	res, err := ep.Run(context.Background(), RunSpec{
+		Code:  "import os, sys; print(sys.stdin.read() + sys.argv[1] + os.environ['TEST_VAR']); print('err', file=sys.stderr)",
+		Args:  []string{"b"},
+		Stdin: strings.NewReader("a"),
+		Env:   []string{"TEST_VAR=c"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "abc\n", string(res.Stdout))
+	assert.Equal(t, "err\n", string(res.Stderr))
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Greater(t, res.WallTime, time.Duration(0))
+
+	res, err = ep.Run(context.Background(), RunSpec{
+		Code:          "import sys; print('x' * 100); sys.exit(3)",
+		MaxOutputSize: 10,
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, res.ExitCode)
+	assert.Equal(t, "xxxxxxxxxx", string(res.Stdout))
+	assert.True(t, res.StdoutTruncated)
+
+	res, err = ep.Run(context.Background(), RunSpec{
+		Code: "import json; json.loads('{')",
+	})
+	var pyErr *PythonError
+	assert.True(t, errors.As(err, &pyErr))
+	assert.Equal(t, "json.decoder.JSONDecodeError", pyErr.Type)
+	assert.Equal(t, "<string>", pyErr.Frames[0].File)
+	assert.Equal(t, 1, res.ExitCode)
+	var exitErr *exec.ExitError
+	assert.True(t, errors.As(err, &exitErr))
+
+	res, err = ep.Run(context.Background(), RunSpec{
+		Code:    "import time; time.sleep(30)",
+		Timeout: 500 * time.Millisecond,
+	})
+	assert.Error(t, err)
+	assert.Less(t, res.WallTime, 5*time.Second)
+}
+
+func TestPythonOpts(t *testing.T) {
+	workDir := t.TempDir()
+	ep := NewPython(
+		WithPythonPath("/path/a", "/path/b"),
+		WithEnv("MY_VAR=my-value"),
+		WithUnbuffered(true),
+		WithDontWriteBytecode(true),
+		WithUTF8Mode(true),
+		WithDevMode(true),
+		WithArgsPrefix("-W", "error::UserWarning"),
+		WithWorkDir(workDir),
+		WithIOEncoding("utf-8:replace"),
+	)
+
+	script := `
+import os, sys
+print(os.environ["MY_VAR"])
+print(os.environ["PYTHONPATH"])
+print(os.environ["PYTHONIOENCODING"])
+print(sys.flags.dont_write_bytecode, sys.flags.utf8_mode, sys.flags.dev_mode)
+print("error::UserWarning" in sys.warnoptions)
+print(os.path.realpath(os.getcwd()) == os.path.realpath(sys.argv[1]))
+`
+	res, err := ep.Run(context.Background(), RunSpec{Code: script, Args: []string{workDir}})
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(res.Stdout)), "\n")
+	assert.Equal(t, []string{
+		"my-value",
+		"/path/a" + string(os.PathListSeparator) + "/path/b",
+		"utf-8:replace",
+		"1 1 True",
+		"True",
+		"True",
+	}, lines)
+}
+
+func TestPythonWith(t *testing.T) {
+	ep := NewPython(WithPythonPath("/path/a"))
+	ep2 := ep.With(WithPythonPath("/path/b"), WithEnv("MY_VAR=x"))
+	ep.AddPythonPath("/path/c")
+	ep2.AddPythonPath("/path/d")
+
+	getEnv := func(p Python) string {
+		res, err := p.Run(context.Background(), RunSpec{Code: "import os; print(os.environ['PYTHONPATH'], os.environ.get('MY_VAR'))"})
+		assert.NoError(t, err)
+		return strings.TrimSpace(string(res.Stdout))
+	}
+	sep := string(os.PathListSeparator)
+	assert.Equal(t, "/path/a"+sep+"/path/c None", getEnv(ep))
+	assert.Equal(t, "/path/a"+sep+"/path/b"+sep+"/path/d x", getEnv(ep2))
+}
+
+func TestAddPythonPathConcurrent(t *testing.T) {
+	ep := NewPython()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ep.AddPythonPath(fmt.Sprintf("/path/%d", i))
+			_, err := ep.PythonCmd("-c", "pass")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	cmd, err := ep.PythonCmd("-c", "pass")
+	assert.NoError(t, err)
+	for _, e := range cmd.Env {
+		if v, ok := strings.CutPrefix(e, "PYTHONPATH="); ok {
+			assert.Len(t, strings.Split(v, string(os.PathListSeparator)), 10)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+//go:build !windows
+
+package python
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// setupGracefulCancel puts the interpreter into its own process group and replaces the default kill-on-cancel
+// behaviour with a SIGINT to the whole process group, like pressing Ctrl+C in a terminal, followed by a SIGKILL to
+// the process group after the grace period.
+func setupGracefulCancel(cmd *exec.Cmd, gracePeriod time.Duration) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		time.AfterFunc(gracePeriod, func() {
+			// this also catches children that outlived the interpreter itself, e.g. because they ignore SIGINT. The
+			// process group ID can't be reused as long as any process is left in the group.
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		err := syscall.Kill(-pgid, syscall.SIGINT)
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	cmd.WaitDelay = gracePeriod
+}
+
+func maxRSS(ps *os.ProcessState) int64 {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	if runtime.GOOS == "darwin" {
+		// darwin reports bytes, everyone else reports kilobytes
+		return int64(ru.Maxrss)
+	}
+	return int64(ru.Maxrss) * 1024
+}
@@ -0,0 +1,18 @@
+package python
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// setupGracefulCancel keeps the default kill-on-cancel behaviour, as Windows has no way to deliver a SIGINT to an
+// arbitrary process. WaitDelay is still set so that Wait does not block forever on pipes held open by children.
+func setupGracefulCancel(cmd *exec.Cmd, gracePeriod time.Duration) {
+	cmd.WaitDelay = gracePeriod
+}
+
+func maxRSS(ps *os.ProcessState) int64 {
+	// not reported by windows
+	return 0
+}
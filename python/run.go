@@ -0,0 +1,151 @@
+package python
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// RunSpec describes a single execution of the interpreter. Exactly one of Code or Script must be set.
+type RunSpec struct {
+	// Code is passed to the interpreter via -c.
+	Code string
+	// Script is the path of a Python script to execute.
+	Script string
+	// Args are passed to the code or script and are available via sys.argv[1:].
+	Args []string
+
+	// Stdin is connected to the stdin of the interpreter. If nil, stdin reads from the null device.
+	Stdin io.Reader
+	// Env contains additional environment variables in the form KEY=value. These take precedence over all other
+	// variables.
+	Env []string
+
+	// Timeout limits the run time of the interpreter. 0 means no timeout.
+	Timeout time.Duration
+	// MaxOutputSize limits the number of bytes captured from stdout and stderr, each. Output that exceeds the limit
+	// is discarded. 0 means no limit.
+	MaxOutputSize int
+}
+
+// RunResult contains the captured output and resource usage of a finished run.
+type RunResult struct {
+	Stdout []byte
+	Stderr []byte
+	// StdoutTruncated and StderrTruncated are set when output was discarded due to RunSpec.MaxOutputSize.
+	StdoutTruncated bool
+	StderrTruncated bool
+
+	ExitCode int
+
+	WallTime   time.Duration
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// MaxRSS is the peak resident set size in bytes. It is 0 on platforms that don't report it.
+	MaxRSS int64
+}
+
+func (ep *python) Run(ctx context.Context, spec RunSpec) (*RunResult, error) {
+	var args []string
+	if spec.Code != "" && spec.Script != "" {
+		return nil, fmt.Errorf("only one of Code and Script can be set")
+	} else if spec.Code != "" {
+		args = append(args, "-c", spec.Code)
+	} else if spec.Script != "" {
+		args = append(args, spec.Script)
+	} else {
+		return nil, fmt.Errorf("either Code or Script must be set")
+	}
+	args = append(args, spec.Args...)
+
+	if spec.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, spec.Timeout)
+		defer cancel()
+	}
+
+	cmd, err := ep.Command(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = mergeEnv(cmd.Env, spec.Env...)
+	cmd.Stdin = spec.Stdin
+
+	stdout := &limitedBuffer{limit: spec.MaxOutputSize}
+	stderr := &limitedBuffer{limit: spec.MaxOutputSize}
+	redirectOutput(cmd.Cmd, StreamStdout, stdout)
+	redirectOutput(cmd.Cmd, StreamStderr, stderr)
+
+	startTime := time.Now()
+	err = cmd.Start()
+	if err != nil {
+		if ep.sandbox != nil && ep.sandbox.usesNamespaces() {
+			return nil, fmt.Errorf("%w: %w", ErrSandboxUnavailable, err)
+		}
+		return nil, err
+	}
+	// also waits for all events to be handled
+	err = cmd.Wait()
+	if cmd.ProcessState == nil {
+		return nil, err
+	}
+
+	res := &RunResult{
+		Stdout:          stdout.buf.Bytes(),
+		Stderr:          stderr.buf.Bytes(),
+		StdoutTruncated: stdout.truncated,
+		StderrTruncated: stderr.truncated,
+		ExitCode:        cmd.ProcessState.ExitCode(),
+		WallTime:        time.Since(startTime),
+		UserTime:        cmd.ProcessState.UserTime(),
+		SystemTime:      cmd.ProcessState.SystemTime(),
+		MaxRSS:          maxRSS(cmd.ProcessState),
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ep.sandbox != nil && res.ExitCode == sandboxSetupFailedExitCode {
+			if msg, ok := sandboxSetupError(res.Stderr); ok {
+				return res, fmt.Errorf("%w: %s", ErrSandboxUnavailable, msg)
+			}
+		}
+		if pyErr := ParseTraceback(res.Stderr); pyErr != nil {
+			pyErr.Err = err
+			err = pyErr
+		}
+	}
+	return res, err
+}
+
+// limitedBuffer captures up to limit bytes and silently discards the rest, so that the child process does not fail
+// on writes.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit > 0 && b.buf.Len()+len(p) > b.limit {
+		p = p[:b.limit-b.buf.Len()]
+		b.truncated = true
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// sandboxSetupError extracts the error message printed by launcher.py when the sandbox could not be set up
+func sandboxSetupError(stderr []byte) (string, bool) {
+	for _, l := range strings.Split(string(stderr), "\n") {
+		if msg, ok := strings.CutPrefix(l, sandboxSetupFailedPrefix); ok {
+			return strings.TrimSpace(msg), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,119 @@
+package python
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrSandboxUnavailable is returned when a Sandbox can't be set up on the current host, e.g. because unprivileged user
+// namespaces are disabled or the platform is not Linux.
+var ErrSandboxUnavailable = errors.New("python sandbox is unavailable")
+
+// sandboxSetupFailedExitCode and sandboxSetupFailedPrefix must match launcher.py
+const (
+	sandboxSetupFailedExitCode = 126
+	sandboxSetupFailedPrefix   = "go-embed-python: sandbox setup failed: "
+)
+
+// Sandbox describes resource limits and namespace isolation that are applied to the interpreter before any user code
+// runs. It is only supported on Linux. See WithSandbox.
+type Sandbox struct {
+	// MaxAddressSpace limits the virtual memory of the interpreter in bytes (RLIMIT_AS). 0 means unlimited.
+	MaxAddressSpace uint64
+	// MaxCPUTime limits the CPU time of the interpreter (RLIMIT_CPU). It is rounded up to full seconds. 0 means
+	// unlimited.
+	MaxCPUTime time.Duration
+	// MaxOpenFiles limits the number of open file descriptors (RLIMIT_NOFILE). 0 means unlimited.
+	MaxOpenFiles uint64
+	// MaxProcesses limits the number of processes and threads (RLIMIT_NPROC). Please note that the kernel counts all
+	// processes of the current user, including the ones outside the sandbox. 0 means unlimited.
+	MaxProcesses uint64
+
+	// IsolateNetwork runs the interpreter in its own network namespace, which only contains a loopback device that is
+	// down.
+	IsolateNetwork bool
+	// IsolatePIDs runs the interpreter in its own PID namespace, so that it can't see or signal other processes. If
+	// IsolateMounts is also set, a new /proc is mounted.
+	IsolatePIDs bool
+	// IsolateMounts runs the interpreter in its own mount namespace. PYTHONHOME, the venv, all Python path entries
+	// and ReadOnlyPaths are bind-mounted read-only and a tmpfs is mounted at ScratchDir.
+	IsolateMounts bool
+
+	// ReadOnlyPaths contains additional paths that are bind-mounted read-only when IsolateMounts is set.
+	ReadOnlyPaths []string
+	// ScratchDir is the path at which a writable tmpfs is mounted when IsolateMounts is set. It hides the original
+	// contents of the path, except for the read-only paths. TMPDIR is set to it. Defaults to os.TempDir().
+	ScratchDir string
+	// ScratchSize limits the size of the scratch tmpfs in bytes. 0 means the kernel default, which is half of the RAM.
+	ScratchSize uint64
+}
+
+// WithSandbox applies the given resource limits and namespace isolation to all commands created by the Python
+// instance. Namespaces are created via unprivileged user namespaces, so root privileges are not required. If the host
+// does not support this, creating commands fails with ErrSandboxUnavailable.
+//
+// The sandbox is set up by a small bootstrap that runs in front of the actual program. Tracebacks and the exit code
+// are the same as without sandbox.
+func WithSandbox(s Sandbox) PythonOpt {
+	return func(o *python) {
+		s.ReadOnlyPaths = append([]string{}, s.ReadOnlyPaths...)
+		o.sandbox = &s
+	}
+}
+
+// sandboxConfig is the sandbox part of launcherConfig
+type sandboxConfig struct {
+	Rlimits  map[string]uint64    `json:"rlimits,omitempty"`
+	Mounts   *sandboxMountsConfig `json:"mounts,omitempty"`
+	DropCaps bool                 `json:"dropCaps,omitempty"`
+}
+
+type sandboxMountsConfig struct {
+	ReadOnly    []string `json:"readOnly,omitempty"`
+	Scratch     string   `json:"scratch,omitempty"`
+	ScratchSize uint64   `json:"scratchSize,omitempty"`
+	Proc        bool     `json:"proc,omitempty"`
+}
+
+func (s *Sandbox) usesNamespaces() bool {
+	return s.IsolateNetwork || s.IsolatePIDs || s.IsolateMounts
+}
+
+func (s *Sandbox) scratchDir() string {
+	if s.ScratchDir != "" {
+		return s.ScratchDir
+	}
+	return os.TempDir()
+}
+
+// buildConfig returns the launcher config for the sandbox. readOnly contains the paths used by the interpreter itself.
+func (s *Sandbox) buildConfig(readOnly []string) *sandboxConfig {
+	cfg := &sandboxConfig{
+		Rlimits: map[string]uint64{},
+	}
+	if s.MaxAddressSpace != 0 {
+		cfg.Rlimits["RLIMIT_AS"] = s.MaxAddressSpace
+	}
+	if s.MaxCPUTime != 0 {
+		cfg.Rlimits["RLIMIT_CPU"] = uint64((s.MaxCPUTime + time.Second - 1) / time.Second)
+	}
+	if s.MaxOpenFiles != 0 {
+		cfg.Rlimits["RLIMIT_NOFILE"] = s.MaxOpenFiles
+	}
+	if s.MaxProcesses != 0 {
+		cfg.Rlimits["RLIMIT_NPROC"] = s.MaxProcesses
+	}
+
+	if s.IsolateMounts {
+		cfg.Mounts = &sandboxMountsConfig{
+			ReadOnly:    append(readOnly, s.ReadOnlyPaths...),
+			Scratch:     s.scratchDir(),
+			ScratchSize: s.ScratchSize,
+			Proc:        s.IsolatePIDs,
+		}
+	}
+	// the interpreter is root inside the user namespace, which must not allow it to undo the mounts
+	cfg.DropCaps = s.usesNamespaces()
+	return cfg
+}
@@ -0,0 +1,67 @@
+//go:build linux
+
+package python
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// setupSandbox configures the namespaces of the sandbox. Resource limits and mounts are applied by launcher.py.
+func setupSandbox(cmd *exec.Cmd, s *Sandbox) error {
+	if !s.usesNamespaces() {
+		return nil
+	}
+	err := checkUserNamespaces()
+	if err != nil {
+		return err
+	}
+
+	flags := syscall.CLONE_NEWUSER
+	if s.IsolateNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	if s.IsolatePIDs {
+		flags |= syscall.CLONE_NEWPID
+	}
+	if s.IsolateMounts {
+		flags |= syscall.CLONE_NEWNS
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= uintptr(flags)
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	return nil
+}
+
+// checkUserNamespaces checks the well known sysctls that disable user namespaces, so that we can fail with a clear
+// error instead of an EPERM when starting the process.
+func checkUserNamespaces() error {
+	readSysctl := func(name string) string {
+		b, err := os.ReadFile("/proc/sys/" + strings.ReplaceAll(name, ".", "/"))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(b))
+	}
+
+	if readSysctl("user.max_user_namespaces") == "0" {
+		return fmt.Errorf("%w: user namespaces are disabled (user.max_user_namespaces=0)", ErrSandboxUnavailable)
+	}
+	if os.Getuid() != 0 {
+		if readSysctl("kernel.unprivileged_userns_clone") == "0" {
+			return fmt.Errorf("%w: unprivileged user namespaces are disabled (kernel.unprivileged_userns_clone=0)", ErrSandboxUnavailable)
+		}
+		if readSysctl("kernel.apparmor_restrict_unprivileged_userns") == "1" {
+			return fmt.Errorf("%w: unprivileged user namespaces are restricted by AppArmor (kernel.apparmor_restrict_unprivileged_userns=1)", ErrSandboxUnavailable)
+		}
+	}
+	return nil
+}
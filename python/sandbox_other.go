@@ -0,0 +1,17 @@
+//go:build !linux
+
+package python
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+func setupSandbox(cmd *exec.Cmd, s *Sandbox) error {
+	return checkUserNamespaces()
+}
+
+func checkUserNamespaces() error {
+	return fmt.Errorf("%w: not supported on %s", ErrSandboxUnavailable, runtime.GOOS)
+}
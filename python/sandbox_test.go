@@ -0,0 +1,179 @@
+package python
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSplitInterpreterArgs(t *testing.T) {
+	tests := []struct {
+		args            []string
+		interpreterArgs []string
+		program         []string
+	}{
+		{[]string{"-c", "code", "a"}, nil, []string{"-c", "code", "a"}},
+		{[]string{"-s", "-u", "-m", "mod", "-c"}, []string{"-s", "-u"}, []string{"-m", "mod", "-c"}},
+		{[]string{"-Bc", "code"}, []string{"-B"}, []string{"-c", "code"}},
+		{[]string{"-ccode", "-u"}, nil, []string{"-c", "code", "-u"}},
+		{[]string{"-W", "error", "-Xutf8", "script.py", "-B"}, []string{"-W", "error", "-X", "utf8"}, []string{"script.py", "-B"}},
+		{[]string{"-sW", "error", "-"}, []string{"-s", "-W", "error"}, []string{"-"}},
+		{[]string{"--check-hash-based-pycs", "never", "--", "-script.py"}, []string{"--check-hash-based-pycs", "never"}, []string{"-script.py"}},
+		{[]string{"-u"}, []string{"-u"}, nil},
+	}
+	for _, tc := range tests {
+		interpreterArgs, program := splitInterpreterArgs(tc.args)
+		assert.Equal(t, tc.interpreterArgs, interpreterArgs, tc.args)
+		assert.Equal(t, tc.program, program, tc.args)
+	}
+}
+
+func newSandboxedPython(t *testing.T, s Sandbox) *EmbeddedPython {
+	if runtime.GOOS != "linux" {
+		t.Skip("sandbox is only supported on linux")
+	}
+	if s.usesNamespaces() {
+		if err := checkUserNamespaces(); err != nil {
+			t.Skip(err)
+		}
+	}
+
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName, WithSandbox(s))
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = ep.Cleanup()
+	})
+	return ep
+}
+
+func TestSandboxRlimits(t *testing.T) {
+	ep := newSandboxedPython(t, Sandbox{
+		MaxAddressSpace: 4 << 30,
+		MaxOpenFiles:    64,
+	})
+
+	res, err := ep.Run(context.Background(), RunSpec{
+		Code: "import resource; print(resource.getrlimit(resource.RLIMIT_NOFILE), resource.getrlimit(resource.RLIMIT_AS)[0])",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("(64, 64) %d\n", uint64(4<<30)), string(res.Stdout))
+
+	res, err = ep.Run(context.Background(), RunSpec{
+		Code: "files = [open('/dev/null') for _ in range(100)]",
+	})
+	var pyErr *PythonError
+	assert.ErrorAs(t, err, &pyErr)
+	assert.Equal(t, "OSError", pyErr.Type)
+	assert.Contains(t, pyErr.Message, "Too many open files")
+}
+
+func TestSandboxNamespaces(t *testing.T) {
+	ep := newSandboxedPython(t, Sandbox{
+		IsolateNetwork: true,
+		IsolatePIDs:    true,
+		IsolateMounts:  true,
+	})
+
+	hostFile := filepath.Join(os.TempDir(), fmt.Sprintf("host-file-%d", rand.Uint32()))
+	assert.NoError(t, os.WriteFile(hostFile, []byte("host"), 0o600))
+	defer os.Remove(hostFile)
+
+	script := `
+import os, socket, sys, tempfile
+print(os.getpid())
+try:
+    socket.create_connection(("1.1.1.1", 80), timeout=5)
+    print("connected")
+except OSError:
+    print("no network")
+try:
+    open(os.path.join(sys.argv[1], "test"), "w")
+    print("home writable")
+except OSError:
+    print("home read-only")
+print(os.path.exists(sys.argv[2]))
+with tempfile.NamedTemporaryFile() as f:
+    print(os.path.dirname(f.name) == os.environ["TMPDIR"])
+`
+	res, err := ep.Run(context.Background(), RunSpec{
+		Code: script,
+		Args: []string{ep.GetExtractedPath(), hostFile},
+	})
+	assert.NoError(t, err, string(res.Stderr))
+	assert.Equal(t, "1\nno network\nhome read-only\nFalse\nTrue\n", string(res.Stdout))
+}
+
+func TestSandboxProgram(t *testing.T) {
+	ep := newSandboxedPython(t, Sandbox{
+		MaxOpenFiles: 256,
+	})
+
+	scriptPath := filepath.Join(t.TempDir(), "script.py")
+	assert.NoError(t, os.WriteFile(scriptPath, []byte("import sys\nprint(sys.argv[1:])\nraise ValueError('script')\n"), 0o600))
+
+	res, err := ep.Run(context.Background(), RunSpec{
+		Script: scriptPath,
+		Args:   []string{"a", "-c"},
+	})
+	assert.Equal(t, "['a', '-c']\n", string(res.Stdout))
+	var pyErr *PythonError
+	assert.ErrorAs(t, err, &pyErr)
+	assert.Equal(t, "ValueError", pyErr.Type)
+	assert.Equal(t, []TracebackFrame{{File: scriptPath, Line: 3, Function: "<module>", Source: "raise ValueError('script')"}}, pyErr.Frames)
+	assert.Equal(t, 1, res.ExitCode)
+
+	res, err = ep.Run(context.Background(), RunSpec{
+		Code: "import sys; print(sys.argv, __name__, sorted(k for k in globals() if not k.startswith('__'))); sys.exit(3)",
+		Args: []string{"x"},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, res.ExitCode)
+	assert.Equal(t, "['-c', 'x'] __main__ ['sys']\n", string(res.Stdout))
+
+	cmd, err := ep.PythonCmd("-m", "json.tool", "--compact")
+	assert.NoError(t, err)
+	cmd.Stdin = strings.NewReader(`{"a": 1}`)
+	out, err := cmd.Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"a\":1}\n", string(out))
+}
+
+func TestSandboxKeyboardInterrupt(t *testing.T) {
+	ep := newSandboxedPython(t, Sandbox{
+		MaxOpenFiles: 256,
+	})
+
+	res, err := ep.Run(context.Background(), RunSpec{
+		Code: "import atexit; atexit.register(print, 'atexit'); raise KeyboardInterrupt()",
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "atexit\n", string(res.Stdout))
+	assert.Contains(t, string(res.Stderr), "KeyboardInterrupt")
+
+	// the interpreter must die from SIGINT, as it would without the launcher
+	var exitErr *exec.ExitError
+	if assert.ErrorAs(t, err, &exitErr) {
+		assert.False(t, exitErr.Exited())
+		assert.Equal(t, syscall.SIGINT, exitErr.Sys().(syscall.WaitStatus).Signal())
+	}
+}
+
+func TestSandboxSetupFailure(t *testing.T) {
+	ep := newSandboxedPython(t, Sandbox{
+		IsolateMounts: true,
+		ScratchDir:    filepath.Join(t.TempDir(), "does-not-exist"),
+	})
+
+	_, err := ep.Run(context.Background(), RunSpec{Code: "pass"})
+	assert.True(t, errors.Is(err, ErrSandboxUnavailable), err)
+}
@@ -0,0 +1,118 @@
+package python
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PythonError describes an uncaught Python exception. It is returned by Run when the interpreter exited due to an
+// uncaught exception and by Worker.Call when the called function raised an exception.
+type PythonError struct {
+	// Type is the exception type. Types that are not builtins are qualified with their module name, e.g.
+	// "json.decoder.JSONDecodeError".
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	// Frames contains the stack frames of the traceback, the innermost frame last.
+	Frames []TracebackFrame `json:"frames,omitempty"`
+	// Traceback is the traceback as formatted by Python.
+	Traceback string `json:"traceback,omitempty"`
+
+	// Err is the underlying error, e.g. the *exec.ExitError of the interpreter process.
+	Err error `json:"-"`
+}
+
+type TracebackFrame struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Function string `json:"function,omitempty"`
+	Source   string `json:"source,omitempty"`
+}
+
+func (e *PythonError) Error() string {
+	if e.Message == "" {
+		return e.Type
+	}
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+func (e *PythonError) Unwrap() error {
+	return e.Err
+}
+
+const tracebackHeader = "Traceback (most recent call last):"
+
+var (
+	tracebackFrameRegex = regexp.MustCompile(`^  File "(.*)", line (\d+)(?:, in (.*))?$`)
+	tracebackCaretRegex = regexp.MustCompile(`^\s*[~^]+\s*$`)
+)
+
+// ParseTraceback parses the last traceback found in the given stderr output of the interpreter. Syntax errors in the
+// main script, which are reported without a "Traceback" header, are also recognized. It returns nil if no traceback
+// was found.
+func ParseTraceback(stderr []byte) *PythonError {
+	s := strings.ReplaceAll(string(stderr), "\r\n", "\n")
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+
+	start := -1
+	for i := len(lines) - 1; i >= 0; i-- {
+		if lines[i] == tracebackHeader {
+			start = i
+			break
+		}
+	}
+	if start == -1 {
+		for i := len(lines) - 1; i >= 0; i-- {
+			if m := tracebackFrameRegex.FindStringSubmatch(lines[i]); m != nil && m[3] == "" {
+				start = i
+				break
+			}
+		}
+	}
+	if start == -1 {
+		return nil
+	}
+	lines = lines[start:]
+
+	e := &PythonError{
+		Traceback: strings.Join(lines, "\n") + "\n",
+	}
+
+	i := 0
+	if lines[0] == tracebackHeader {
+		i++
+	}
+	for ; i < len(lines); i++ {
+		l := lines[i]
+		if m := tracebackFrameRegex.FindStringSubmatch(l); m != nil {
+			line, _ := strconv.Atoi(m[2])
+			e.Frames = append(e.Frames, TracebackFrame{
+				File:     m[1],
+				Line:     line,
+				Function: m[3],
+			})
+		} else if strings.HasPrefix(l, "    ") {
+			if len(e.Frames) != 0 && e.Frames[len(e.Frames)-1].Source == "" && !tracebackCaretRegex.MatchString(l) {
+				e.Frames[len(e.Frames)-1].Source = strings.TrimSpace(l)
+			}
+		} else if strings.HasPrefix(l, "  ") {
+			// e.g. "  [Previous line repeated 996 more times]"
+			continue
+		} else {
+			break
+		}
+	}
+	if i >= len(lines) {
+		return nil
+	}
+
+	exc := strings.Join(lines[i:], "\n")
+	if t, msg, ok := strings.Cut(exc, ": "); ok && !strings.ContainsAny(t, " \n") {
+		e.Type = t
+		e.Message = msg
+	} else {
+		e.Type = exc
+	}
+	return e
+}
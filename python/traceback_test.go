@@ -0,0 +1,97 @@
+package python
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseTraceback(t *testing.T) {
+	type testCase struct {
+		name    string
+		stderr  string
+		typ     string
+		message string
+		frames  []TracebackFrame
+	}
+
+	tests := []testCase{
+		{
+			name:   "no traceback",
+			stderr: "some output\n",
+		},
+		{
+			name: "simple",
+			stderr: `Traceback (most recent call last):
+  File "/tmp/test.py", line 5, in <module>
+    main()
+  File "/tmp/test.py", line 3, in main
+    int("x")
+ValueError: invalid literal for int() with base 10: 'x'
+`,
+			typ:     "ValueError",
+			message: "invalid literal for int() with base 10: 'x'",
+			frames: []TracebackFrame{
+				{File: "/tmp/test.py", Line: 5, Function: "<module>", Source: "main()"},
+				{File: "/tmp/test.py", Line: 3, Function: "main", Source: `int("x")`},
+			},
+		},
+		{
+			name: "carets and chained",
+			stderr: `Traceback (most recent call last):
+  File "<string>", line 1, in <module>
+KeyError: 'a'
+
+During handling of the above exception, another exception occurred:
+
+Traceback (most recent call last):
+  File "<string>", line 1, in <module>
+    import x; {}["a"]
+    ~~~~~~^^^^^
+ModuleNotFoundError: No module named 'x'
+`,
+			typ:     "ModuleNotFoundError",
+			message: "No module named 'x'",
+			frames: []TracebackFrame{
+				{File: "<string>", Line: 1, Function: "<module>", Source: `import x; {}["a"]`},
+			},
+		},
+		{
+			name: "qualified type without message",
+			stderr: `Traceback (most recent call last):
+  File "<string>", line 1, in <module>
+mymodule.MyError
+`,
+			typ: "mymodule.MyError",
+			frames: []TracebackFrame{
+				{File: "<string>", Line: 1, Function: "<module>"},
+			},
+		},
+		{
+			name: "syntax error",
+			stderr: `  File "<string>", line 1
+    print(
+         ^
+SyntaxError: '(' was never closed
+`,
+			typ:     "SyntaxError",
+			message: "'(' was never closed",
+			frames: []TracebackFrame{
+				{File: "<string>", Line: 1, Source: "print("},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := ParseTraceback([]byte(tc.stderr))
+			if tc.typ == "" {
+				assert.Nil(t, e)
+				return
+			}
+			assert.NotNil(t, e)
+			assert.Equal(t, tc.typ, e.Type)
+			assert.Equal(t, tc.message, e.Message)
+			assert.Equal(t, tc.frames, e.Frames)
+		})
+	}
+}
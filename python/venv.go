@@ -0,0 +1,94 @@
+package python
+
+import (
+	"fmt"
+	"github.com/kluctl/go-embed-python/internal"
+	"path/filepath"
+	"runtime"
+)
+
+type VenvOptions struct {
+	// SystemSitePackages gives the venv access to the site-packages of the embedded distribution.
+	SystemSitePackages bool
+	// Clear deletes the contents of the venv directory if it already exists.
+	Clear bool
+	// SeedPaths contains directories whose contents are copied into the site-packages of the venv. This can for
+	// example be used to seed pip by passing the extracted path of pip.NewPipLib. See also pip.CreateVenv.
+	SeedPaths []string
+	// PythonOpts are additional options for the Python returned as part of the Venv.
+	PythonOpts []PythonOpt
+}
+
+// Venv is a virtual environment created from an EmbeddedPython. Its embedded Python runs the venv's interpreter.
+type Venv struct {
+	Python
+	path string
+}
+
+// CreateVenv creates a new virtual environment at the given path, using `python -m venv --without-pip`.
+//
+// The venv references the extracted distribution of ep, so it will only be usable as long as ep has not been
+// cleaned up.
+func (ep *EmbeddedPython) CreateVenv(path string, opts VenvOptions) (*Venv, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-m", "venv", "--without-pip"}
+	if opts.SystemSitePackages {
+		args = append(args, "--system-site-packages")
+	}
+	if opts.Clear {
+		args = append(args, "--clear")
+	}
+	args = append(args, path)
+
+	cmd, err := ep.PythonCmd(args...)
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create venv at %s: %w\n%s", path, err, string(out))
+	}
+
+	v := &Venv{
+		Python: NewPython(append([]PythonOpt{WithVenv(path)}, opts.PythonOpts...)...),
+		path:   path,
+	}
+
+	if len(opts.SeedPaths) != 0 {
+		sitePackages, err := v.GetSitePackagesPath()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range opts.SeedPaths {
+			err = internal.CopyDir(p, sitePackages)
+			if err != nil {
+				return nil, fmt.Errorf("failed to seed venv from %s: %w", p, err)
+			}
+		}
+	}
+
+	return v, nil
+}
+
+func (v *Venv) GetPath() string {
+	return v.path
+}
+
+// GetSitePackagesPath returns the path of the site-packages directory of the venv.
+func (v *Venv) GetSitePackagesPath() (string, error) {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(v.path, "Lib", "site-packages"), nil
+	}
+	matches, err := filepath.Glob(filepath.Join(v.path, "lib", "python3*", "site-packages"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) != 1 {
+		return "", fmt.Errorf("failed to determine site-packages of venv at %s", v.path)
+	}
+	return matches[0], nil
+}
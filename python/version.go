@@ -0,0 +1,90 @@
+package python
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kluctl/go-embed-python/python/internal/data"
+	"io/fs"
+	"runtime"
+)
+
+// EmbeddedVersionInfo describes the embedded Python distribution.
+type EmbeddedVersionInfo struct {
+	// PythonVersion is the full Python version, e.g. "3.11.11".
+	PythonVersion string `json:"pythonVersion"`
+	// StandaloneVersion is the python-build-standalone release the distribution was taken from, which is the
+	// build date in the form YYYYMMDD.
+	StandaloneVersion string `json:"pythonStandaloneVersion"`
+	// Target is the target triple of the distribution, e.g. "x86_64-unknown-linux-gnu".
+	Target string `json:"target"`
+	// Flavor is the distribution flavor, e.g. "pgo+lto-full".
+	Flavor string `json:"flavor"`
+}
+
+// EmbeddedVersion returns information about the embedded Python distribution. It does not require the distribution
+// to be extracted or the interpreter to be started.
+func EmbeddedVersion() (*EmbeddedVersionInfo, error) {
+	if data.Data == nil {
+		return nil, fmt.Errorf("%w: %s/%s", ErrUnsupportedPlatform, runtime.GOOS, runtime.GOARCH)
+	}
+	b, err := fs.ReadFile(data.Data, "version.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded version info: %w", err)
+	}
+	var vi EmbeddedVersionInfo
+	err = json.Unmarshal(b, &vi)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse embedded version info: %w", err)
+	}
+	return &vi, nil
+}
+
+// VersionInfo mirrors Python's sys.version_info.
+type VersionInfo struct {
+	Major        int    `json:"major"`
+	Minor        int    `json:"minor"`
+	Micro        int    `json:"micro"`
+	ReleaseLevel string `json:"releaselevel"`
+	Serial       int    `json:"serial"`
+}
+
+func (v VersionInfo) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Micro)
+	switch v.ReleaseLevel {
+	case "alpha":
+		s += fmt.Sprintf("a%d", v.Serial)
+	case "beta":
+		s += fmt.Sprintf("b%d", v.Serial)
+	case "candidate":
+		s += fmt.Sprintf("rc%d", v.Serial)
+	}
+	return s
+}
+
+// AtLeast returns true if the version is equal to or newer than major.minor.
+func (v VersionInfo) AtLeast(major int, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+const versionInfoCode = `
+import json, sys
+v = sys.version_info
+print(json.dumps({"major": v.major, "minor": v.minor, "micro": v.micro, "releaselevel": v.releaselevel, "serial": v.serial}))
+`
+
+func (ep *python) Version(ctx context.Context) (*VersionInfo, error) {
+	res, err := ep.Run(ctx, RunSpec{
+		Code: versionInfoCode,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query python version: %w", err)
+	}
+
+	var v VersionInfo
+	err = json.Unmarshal(res.Stdout, &v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse python version: %w", err)
+	}
+	return &v, nil
+}
@@ -0,0 +1,323 @@
+package python
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+//go:embed worker.py
+var workerBootstrap string
+
+// ErrWorkerClosed is returned when calling into a Worker that has been closed or whose interpreter has exited.
+var ErrWorkerClosed = errors.New("python worker is closed")
+
+const workerCloseTimeout = 5 * time.Second
+
+// Worker is a long-running Python interpreter that executes function calls sent to it from Go. This avoids the
+// interpreter startup cost that comes with spawning a new process for every call.
+//
+// Requests and responses are exchanged as length-prefixed JSON messages through the stdin and stdout of the
+// interpreter. Everything printed to stdout by the called Python code is redirected to stderr.
+type Worker struct {
+	cmd    *Cmd
+	cancel context.CancelFunc
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+
+	stderr io.Writer
+
+	// callMutex serializes calls. mutex protects the state below and is never held while talking to the
+	// interpreter, so that Close does not have to wait for a call that hangs.
+	callMutex sync.Mutex
+	mutex     sync.Mutex
+	closed    bool
+	busy      bool
+	calls     int
+
+	done    chan struct{}
+	waitErr error
+}
+
+type WorkerOpt func(w *Worker)
+
+// WithWorkerStderr sets the writer that receives everything written to stdout and stderr by the worker. By default,
+// this output is discarded.
+func WithWorkerStderr(stderr io.Writer) WorkerOpt {
+	return func(w *Worker) {
+		w.stderr = stderr
+	}
+}
+
+// NewWorker starts a new interpreter with the worker bootstrap loaded. The worker must be closed via Close when it is
+// not needed anymore.
+func NewWorker(p Python, opts ...WorkerOpt) (*Worker, error) {
+	w := &Worker{
+		done: make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(w)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd, err := p.Command(ctx, "-c", workerBootstrap)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// stdout is reserved for the protocol, user code writes to stderr instead
+	cmd.Stdout = nil
+	if w.stderr != nil {
+		redirectOutput(cmd.Cmd, StreamStderr, w.stderr)
+	}
+
+	w.stdin, err = cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	w.stdout = bufio.NewReader(stdout)
+
+	err = cmd.Start()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	w.cmd = cmd
+	w.cancel = cancel
+
+	go func() {
+		w.waitErr = cmd.Wait()
+		close(w.done)
+	}()
+
+	return w, nil
+}
+
+type workerRequest struct {
+	Module   string          `json:"module"`
+	Function string          `json:"function"`
+	Args     json.RawMessage `json:"args,omitempty"`
+}
+
+type workerResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *PythonError    `json:"error"`
+}
+
+// Call invokes module.function inside the worker and decodes the JSON encoded return value into result. If result is
+// nil, the return value is ignored.
+//
+// args is JSON encoded and passed to the function as follows: a list is passed as positional arguments, a map/struct
+// is passed as keyword arguments and nil results in no arguments. Any other value is passed as the only positional
+// argument.
+//
+// If the Python function raises an exception, a *PythonError is returned. Calls are executed one at a time. If ctx is
+// done before the call has finished, the worker is killed, as its state is unknown at that point. All further calls
+// will then fail with ErrWorkerClosed.
+func (w *Worker) Call(ctx context.Context, module string, function string, args any, result any) error {
+	return w.call(ctx, module, function, args, result, true)
+}
+
+func (w *Worker) call(ctx context.Context, module string, function string, args any, result any, count bool) error {
+	req := workerRequest{
+		Module:   module,
+		Function: function,
+	}
+	if args != nil {
+		b, err := json.Marshal(args)
+		if err != nil {
+			return fmt.Errorf("failed to marshal args: %w", err)
+		}
+		req.Args = b
+	}
+	reqData, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+
+	w.callMutex.Lock()
+	defer w.callMutex.Unlock()
+
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return ErrWorkerClosed
+	}
+	if count {
+		w.calls++
+	}
+	w.busy = true
+	w.mutex.Unlock()
+	defer w.setBusy(false)
+
+	type callResult struct {
+		data []byte
+		err  error
+	}
+	ch := make(chan callResult, 1)
+	go func() {
+		data, err := w.roundTrip(reqData)
+		ch <- callResult{data: data, err: err}
+	}()
+
+	var respData []byte
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			w.markClosed()
+			w.kill()
+			return w.exitError(r.err)
+		}
+		respData = r.data
+	case <-ctx.Done():
+		w.markClosed()
+		w.kill()
+		<-ch
+		return ctx.Err()
+	}
+
+	var resp workerResponse
+	err = json.Unmarshal(respData, &resp)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil {
+		err = json.Unmarshal(resp.Result, result)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal result: %w", err)
+		}
+	}
+	return nil
+}
+
+func (w *Worker) roundTrip(reqData []byte) ([]byte, error) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(reqData)))
+	_, err := w.stdin.Write(append(header[:], reqData...))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.ReadFull(w.stdout, header[:])
+	if err != nil {
+		return nil, err
+	}
+	respData := make([]byte, binary.BigEndian.Uint32(header[:]))
+	_, err = io.ReadFull(w.stdout, respData)
+	if err != nil {
+		return nil, err
+	}
+	return respData, nil
+}
+
+// exitError waits for the interpreter to exit and returns an error that describes why communication failed.
+func (w *Worker) exitError(err error) error {
+	<-w.done
+	if w.waitErr != nil {
+		return fmt.Errorf("%w: %v", ErrWorkerClosed, w.waitErr)
+	}
+	return fmt.Errorf("%w: %v", ErrWorkerClosed, err)
+}
+
+func (w *Worker) setBusy(busy bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.busy = busy
+}
+
+func (w *Worker) markClosed() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.closed = true
+}
+
+func (w *Worker) kill() {
+	w.cancel()
+	_ = w.stdin.Close()
+}
+
+// Pid returns the process id of the interpreter.
+func (w *Worker) Pid() int {
+	return w.cmd.Process.Pid
+}
+
+// Calls returns the number of calls made through Call so far, including failed calls.
+func (w *Worker) Calls() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.calls
+}
+
+// WorkerStats contains runtime information about the interpreter of a Worker.
+type WorkerStats struct {
+	Pid int `json:"pid"`
+	// RSS is the resident set size of the interpreter in bytes. On platforms where the current RSS is unavailable,
+	// the peak RSS is reported instead. It is 0 if neither is available.
+	RSS int64 `json:"rss"`
+}
+
+// Stats queries the interpreter for its runtime information. It also serves as a health check, as it fails if the
+// interpreter is not responsive anymore.
+func (w *Worker) Stats(ctx context.Context) (*WorkerStats, error) {
+	var st WorkerStats
+	err := w.call(ctx, "__main__", "_stats", nil, &st, false)
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (w *Worker) isClosed() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.closed
+}
+
+// Close stops the worker. The interpreter is first asked to exit by closing its stdin. If it does not exit in time,
+// it is interrupted and eventually killed. If a call is in progress, the interpreter is interrupted right away and the
+// call fails with ErrWorkerClosed.
+func (w *Worker) Close() error {
+	w.mutex.Lock()
+	wasClosed := w.closed
+	busy := w.busy
+	w.closed = true
+	w.mutex.Unlock()
+
+	if !wasClosed {
+		_ = w.stdin.Close()
+		if !busy {
+			select {
+			case <-w.done:
+			case <-time.After(workerCloseTimeout):
+			}
+		}
+	}
+	w.cancel()
+	<-w.done
+
+	var exitErr *exec.ExitError
+	if errors.As(w.waitErr, &exitErr) && !exitErr.Exited() {
+		// killed by us
+		return nil
+	} else if errors.Is(w.waitErr, context.Canceled) {
+		return nil
+	}
+	return w.waitErr
+}
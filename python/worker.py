@@ -0,0 +1,110 @@
+# Bootstrap module of python.Worker. It reads length-prefixed JSON requests from the original stdin, invokes the
+# requested functions and writes length-prefixed JSON responses to the original stdout. Both file descriptors are
+# moved out of the way before any user code runs, so that print() and friends can't interfere with the protocol.
+import importlib
+import json
+import os
+import struct
+import sys
+import traceback
+
+
+def _setup_io():
+    proto_in = os.fdopen(os.dup(0), "rb")
+    proto_out = os.fdopen(os.dup(1), "wb")
+
+    devnull = os.open(os.devnull, os.O_RDONLY)
+    os.dup2(devnull, 0)
+    os.close(devnull)
+    os.dup2(2, 1)
+
+    sys.stdin = open(os.devnull, "r")
+    sys.stdout = sys.stderr
+    return proto_in, proto_out
+
+
+def _read_message(f):
+    header = f.read(4)
+    if len(header) == 0:
+        return None
+    if len(header) != 4:
+        raise EOFError("unexpected EOF while reading message header")
+    n, = struct.unpack(">I", header)
+    data = f.read(n)
+    if len(data) != n:
+        raise EOFError("unexpected EOF while reading message")
+    return json.loads(data)
+
+
+def _write_message(f, data):
+    f.write(struct.pack(">I", len(data)))
+    f.write(data)
+    f.flush()
+
+
+def _call(req):
+    module = importlib.import_module(req["module"])
+    func = getattr(module, req["function"])
+    args = req.get("args")
+    if args is None:
+        return func()
+    elif isinstance(args, list):
+        return func(*args)
+    elif isinstance(args, dict):
+        return func(**args)
+    else:
+        return func(args)
+
+
+def _stats():
+    rss = 0
+    try:
+        with open("/proc/self/statm") as f:
+            rss = int(f.read().split()[1]) * os.sysconf("SC_PAGE_SIZE")
+    except (OSError, ValueError, AttributeError):
+        try:
+            import resource
+            rss = resource.getrusage(resource.RUSAGE_SELF).ru_maxrss
+            if sys.platform != "darwin":
+                rss *= 1024
+        except ImportError:
+            pass
+    return {"pid": os.getpid(), "rss": rss}
+
+
+def _extract_frames(e):
+    # the first two frames belong to the bootstrap itself
+    return [{
+        "file": f.filename,
+        "line": f.lineno,
+        "function": f.name,
+        "source": f.line,
+    } for f in traceback.extract_tb(e.__traceback__)[2:]]
+
+
+def _exception_type_name(e):
+    t = type(e)
+    if t.__module__ == "builtins":
+        return t.__qualname__
+    return "%s.%s" % (t.__module__, t.__qualname__)
+
+
+def main():
+    proto_in, proto_out = _setup_io()
+    while True:
+        req = _read_message(proto_in)
+        if req is None:
+            break
+        try:
+            resp = json.dumps({"result": _call(req)})
+        except Exception as e:
+            resp = json.dumps({"error": {
+                "type": _exception_type_name(e),
+                "message": str(e),
+                "frames": _extract_frames(e),
+                "traceback": "".join(traceback.format_exception(type(e), e, e.__traceback__)),
+            }})
+        _write_message(proto_out, resp.encode("utf-8"))
+
+
+main()
@@ -0,0 +1,219 @@
+package python
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorker(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	w, err := NewWorker(ep)
+	assert.NoError(t, err)
+	defer w.Close()
+
+	var f float64
+	err = w.Call(context.Background(), "math", "sqrt", []any{16}, &f)
+	assert.NoError(t, err)
+	assert.Equal(t, 4.0, f)
+
+	// printing must not interfere with the protocol
+	err = w.Call(context.Background(), "builtins", "print", []any{"test"}, nil)
+	assert.NoError(t, err)
+
+	var s string
+	err = w.Call(context.Background(), "posixpath", "join", []any{"a", "b"}, &s)
+	assert.NoError(t, err)
+	assert.Equal(t, "a/b", s)
+
+	var m map[string]any
+	err = w.Call(context.Background(), "json", "loads", map[string]any{"s": `{"a": 1}`}, &m)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": 1.0}, m)
+
+	err = w.Call(context.Background(), "json", "loads", "{", nil)
+	var we *PythonError
+	assert.True(t, errors.As(err, &we))
+	assert.Equal(t, "json.decoder.JSONDecodeError", we.Type)
+	assert.Contains(t, we.Traceback, "Traceback (most recent call last)")
+	assert.NotEmpty(t, we.Frames)
+	assert.Equal(t, "loads", we.Frames[0].Function)
+
+	err = w.Call(context.Background(), "does_not_exist", "f", nil, nil)
+	assert.True(t, errors.As(err, &we))
+	assert.Equal(t, "ModuleNotFoundError", we.Type)
+
+	assert.NoError(t, w.Close())
+	err = w.Call(context.Background(), "math", "sqrt", []any{16}, &f)
+	assert.ErrorIs(t, err, ErrWorkerClosed)
+}
+
+func TestWorkerCancel(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	w, err := NewWorker(ep)
+	assert.NoError(t, err)
+	defer w.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err = w.Call(ctx, "time", "sleep", []any{30}, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = w.Call(context.Background(), "math", "sqrt", []any{16}, nil)
+	assert.ErrorIs(t, err, ErrWorkerClosed)
+}
+
+func TestWorkerCloseDuringCall(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	w, err := NewWorker(ep)
+	assert.NoError(t, err)
+
+	callErr := make(chan error, 1)
+	go func() {
+		callErr <- w.Call(context.Background(), "time", "sleep", []any{60}, nil)
+	}()
+	// wait until the call is in progress
+	for start := time.Now(); w.Calls() == 0 && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	assert.NoError(t, w.Close())
+	assert.Less(t, time.Since(start), workerCloseTimeout)
+
+	select {
+	case err = <-callErr:
+		assert.ErrorIs(t, err, ErrWorkerClosed)
+	case <-time.After(10 * time.Second):
+		t.Fatal("call did not return after Close")
+	}
+}
+
+func TestPool(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	p, err := NewPool(ep, WithPoolSize(2), WithPoolMaxCalls(3))
+	assert.NoError(t, err)
+	defer p.Close()
+
+	var mutex sync.Mutex
+	pids := map[int]bool{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var pid int
+			err := p.Call(context.Background(), "os", "getpid", nil, &pid)
+			assert.NoError(t, err)
+			mutex.Lock()
+			pids[pid] = true
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// workers are recycled after 3 calls, so at least 7 different interpreters must have been involved
+	assert.GreaterOrEqual(t, len(pids), 7)
+
+	// crashing workers are replaced transparently
+	err = p.Call(context.Background(), "os", "_exit", []any{1}, nil)
+	assert.ErrorIs(t, err, ErrWorkerClosed)
+	for i := 0; i < 4; i++ {
+		err = p.Call(context.Background(), "os", "getpid", nil, nil)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, p.Close())
+	err = p.Call(context.Background(), "os", "getpid", nil, nil)
+	assert.ErrorIs(t, err, ErrPoolClosed)
+}
+
+func TestPoolMaxQueue(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	p, err := NewPool(ep, WithPoolSize(1), WithPoolMaxQueue(2), WithPoolHealthCheckInterval(0))
+	assert.NoError(t, err)
+	defer p.Close()
+
+	// occupy the only worker, then fill the queue
+	busyCtx, cancelBusy := context.WithCancel(context.Background())
+	busyDone := make(chan struct{})
+	go func() {
+		defer close(busyDone)
+		_ = p.Call(busyCtx, "time", "sleep", []any{60}, nil)
+	}()
+	defer func() {
+		cancelBusy()
+		<-busyDone
+	}()
+	assert.Eventually(t, func() bool { return len(p.idle) == 0 }, 10*time.Second, 10*time.Millisecond)
+
+	waitCtx, cancelWait := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.Call(waitCtx, "os", "getpid", nil, nil)
+			assert.ErrorIs(t, err, context.Canceled)
+		}()
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&p.waiting) == 2 }, 10*time.Second, 10*time.Millisecond)
+
+	startTime := time.Now()
+	err = p.Call(context.Background(), "os", "getpid", nil, nil)
+	assert.ErrorIs(t, err, ErrPoolQueueFull)
+	assert.Less(t, time.Since(startTime), time.Second)
+
+	cancelWait()
+	wg.Wait()
+}
+
+func TestPoolMaxRSS(t *testing.T) {
+	rndName := fmt.Sprintf("test-%d", rand.Uint32())
+	ep, err := NewEmbeddedPython(rndName)
+	assert.NoError(t, err)
+	defer ep.Cleanup()
+
+	// the limit must be enforced after calls, even without health checks
+	p, err := NewPool(ep, WithPoolSize(1), WithPoolMaxRSS(1), WithPoolHealthCheckInterval(0))
+	assert.NoError(t, err)
+	defer p.Close()
+
+	pids := map[int]bool{}
+	for i := 0; i < 3; i++ {
+		var pid int
+		err = p.Call(context.Background(), "os", "getpid", nil, &pid)
+		assert.NoError(t, err)
+		pids[pid] = true
+	}
+	assert.Len(t, pids, 3)
+}